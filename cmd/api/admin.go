@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/data"
+	"github.com/shakilbd009/go-greenlight-api/internal/validator"
+)
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name      string
+		Email     string
+		Activated *bool
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.Name = app.readString(qs, "name", "")
+	input.Email = app.readString(qs, "email", "")
+	if s := qs.Get("activated"); s != "" {
+		activated, err := strconv.ParseBool(s)
+		if err != nil {
+			v.AddError("activated", "must be a boolean value")
+		}
+		input.Activated = &activated
+	}
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Name, input.Email, input.Activated, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showUserHandler returns a user along with the lockout state of their account.
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	lock, err := app.models.LoginFailures.Get(data.LoginScopeAccount, strings.ToLower(user.Email), app.config.lockout.window)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user, "lock": lock}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The unlockUserHandler lifts a login lockout on a user's account and resets its count
+// of failed logins.
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	if err := app.models.LoginFailures.Clear(data.LoginScopeAccount, strings.ToLower(user.Email)); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "user account successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateUserHandler lets an admin activate or deactivate a user account. When an
+// account is deactivated, all of its authentication and refresh tokens are revoked too.
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Activated *bool `json:"activated"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Activated != nil, "activated", "must be provided")
+	if input.Activated != nil && !*input.Activated {
+		v.Check(user.ID != app.contextGetUser(r).ID, "activated", "you cannot deactivate your own account")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user.Activated = *input.Activated
+	err := app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !user.Activated {
+		if err := app.revokeAllSessions(user.ID); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	if id == app.contextGetUser(r).ID {
+		v := validator.New()
+		v.AddError("id", "you cannot delete your own account")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Users.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.revokeUserLocally(id)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showUserPermissionsHandler returns the permissions granted directly to a user,
+// along with their effective permissions (which also include those from roles).
+func (app *application) showUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// The grantUserPermissionsHandler grants one or more permissions directly to a user.
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, codes, ok := app.readUserPermissionsInput(w, r)
+	if !ok {
+		return
+	}
+	if err := app.models.Permissions.AddForUser(user.ID, codes...); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// The revokeUserPermissionsHandler removes one or more permissions which were granted
+// directly to a user.
+func (app *application) revokeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, codes, ok := app.readUserPermissionsInput(w, r)
+	if !ok {
+		return
+	}
+	if err := app.models.Permissions.RemoveForUser(user.ID, codes...); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// The readUserPermissionsInput() helper looks up the user from the URL, then reads and
+// validates a {"permissions": [...]} request body.
+func (app *application) readUserPermissionsInput(w http.ResponseWriter, r *http.Request) (*data.User, []string, bool) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, nil, false
+	}
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, nil, false
+	}
+	v := validator.New()
+	v.Check(len(input.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range input.Permissions {
+		v.Check(known.Include(code), "permissions", "must only contain known permission codes")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, nil, false
+	}
+	return user, input.Permissions, true
+}
+
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, userID int64) {
+	direct, err := app.models.Permissions.GetDirectForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	effective, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": direct, "effective_permissions": effective}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readUserParam() helper looks up the user identified by the "id" URL parameter,
+// sending a 404 Not Found response and returning false if there is no such user.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return user, true
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/data"
+	"github.com/shakilbd009/go-greenlight-api/internal/jwt"
+)
+
+// The issueSession() helper creates a new authentication token and refresh token for a
+// user and sends them in a 201 Created response. In authModeJWT only the refresh token
+// is stored; the authentication token is a signed JWT carrying the user's permissions.
+func (app *application) issueSession(w http.ResponseWriter, r *http.Request, user *data.User, family string) {
+	var token, refreshToken *data.Token
+	var err error
+	if app.config.auth.mode == authModeJWT {
+		refreshToken, err = app.models.Tokens.NewRefresh(user.ID, app.config.auth.refreshTTL, r.UserAgent(), app.clientIP(r), family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		token, err = app.signAccessToken(user, refreshToken.Family)
+	} else {
+		token, refreshToken, err = app.models.Tokens.NewSession(user.ID, app.config.auth.accessTTL, app.config.auth.refreshTTL, r.UserAgent(), app.clientIP(r), family)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env := envelope{"authentication_token": token, "refresh_token": refreshToken}
+	if err := app.writeJSON(w, http.StatusCreated, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The signAccessToken() helper creates a JWT for the user. The user's permissions and
+// MFA status are looked up now and embedded in the token, so changes to them only take
+// effect when the token is next refreshed.
+func (app *application) signAccessToken(user *data.User, family string) (*data.Token, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	mfaEnabled, err := app.models.MFA.Enabled(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expiry := now.Add(app.config.auth.accessTTL)
+	signed, err := app.jwtKeys.Sign(jwt.Claims{
+		Subject:     strconv.FormatInt(user.ID, 10),
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   expiry.Unix(),
+		Activated:   user.Activated,
+		Permissions: permissions,
+		Family:      family,
+		MFA:         mfaEnabled,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &data.Token{Plaintext: signed, UserID: user.ID, Expiry: expiry, Scope: data.ScopeAuthentication, Family: family}, nil
+}
+
+// The verifyAccessToken() helper checks a JWT and returns its claims along with a
+// (partial) user record built from them. Tokens which have been revoked on this
+// instance, individually, by family or for the whole user, are rejected. Revoking a
+// user only rejects the tokens issued up to that point, so that they can log in again
+// (after resetting their password, say) straight away.
+func (app *application) verifyAccessToken(token string) (*data.User, *jwt.Claims, error) {
+	claims, err := app.jwtKeys.Verify(token, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+	if app.jwtRevoked.Revoked(claims.ID) {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+	if at, ok := app.jwtRevoked.RevokedAt(revokedUserKey(id)); ok && claims.IssuedAt <= at.Unix() {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+	if claims.Family != "" && app.jwtRevoked.Revoked(claims.Family) {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+	return &data.User{ID: id, Activated: claims.Activated}, claims, nil
+}
+
+// The revokeFamilyLocally() helper stops any JWTs issued to a token family from being
+// accepted by this instance. It's a no-op in authModeToken, where deleting the tokens
+// from the database is enough.
+func (app *application) revokeFamilyLocally(family string) {
+	if app.jwtRevoked != nil && family != "" {
+		app.jwtRevoked.Revoke(family, time.Now().Add(app.config.auth.accessTTL))
+	}
+}
+
+// The revokeUserLocally() helper stops any JWTs which have been issued to a user so far
+// from being accepted by this instance, for example after their account is deactivated.
+func (app *application) revokeUserLocally(userID int64) {
+	if app.jwtRevoked != nil {
+		app.jwtRevoked.Revoke(revokedUserKey(userID), time.Now().Add(app.config.auth.accessTTL))
+	}
+}
+
+// The revokeAllSessions() helper logs a user out everywhere: all of their authentication
+// and refresh tokens are deleted, and any JWTs already issued to them are revoked. This
+// includes the tokens of OAuth clients, as it is used when an account may have been
+// compromised; a password change by the user themselves leaves them alone (see
+// TokenModel.DeleteOtherSessions()).
+func (app *application) revokeAllSessions(userID int64) error {
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		if err := app.models.Tokens.DeleteAllForUser(scope, userID); err != nil {
+			return err
+		}
+	}
+	app.revokeUserLocally(userID)
+	return nil
+}
+
+func revokedUserKey(userID int64) string {
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+// The sessionScope() helper returns the scope of the tokens which represent sessions:
+// authentication tokens normally, or refresh tokens in authModeJWT, where
+// authentication tokens aren't stored.
+func (app *application) sessionScope() string {
+	if app.config.auth.mode == authModeJWT {
+		return data.ScopeRefresh
+	}
+	return data.ScopeAuthentication
+}
+
+// The currentUser() helper returns the full user record for the authenticated user.
+// In authModeJWT the user in the request context only has the ID and activation state
+// from the token, so the record is read from the database.
+func (app *application) currentUser(r *http.Request) (*data.User, error) {
+	user := app.contextGetUser(r)
+	if app.contextGetClaims(r) == nil {
+		return user, nil
+	}
+	user, err := app.models.Users.Get(user.ID)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		// The account was deleted after the token was issued.
+		return nil, jwt.ErrInvalidToken
+	}
+	return user, err
+}
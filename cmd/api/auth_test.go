@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/jwt"
+)
+
+func TestVerifyAccessTokenRevocation(t *testing.T) {
+	keys, err := jwt.NewRandomKeys(jwt.AlgHS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &application{jwtKeys: keys, jwtRevoked: jwt.NewRevocationList()}
+	app.config.auth.accessTTL = time.Minute
+
+	now := time.Now()
+	sign := func(subject, id, family string, issuedAt time.Time) string {
+		token, err := keys.Sign(jwt.Claims{
+			Subject:   subject,
+			ID:        id,
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: now.Add(time.Minute).Unix(),
+			Family:    family,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	app.jwtRevoked.Revoke("revoked-id", now.Add(time.Minute))
+	app.revokeFamilyLocally("revoked-family")
+	app.revokeUserLocally(7)
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"not revoked", sign("1", "id", "family", now), true},
+		{"revoked by ID", sign("1", "revoked-id", "family", now), false},
+		{"revoked by family", sign("1", "id", "revoked-family", now), false},
+		{"other family", sign("1", "id", "family", now), true},
+		{"user revoked, issued before", sign("7", "id", "family", now.Add(-10*time.Second)), false},
+		{"user revoked, issued in the same second", sign("7", "id", "family", now), false},
+		{"user revoked, issued after", sign("7", "id", "family", now.Add(2*time.Second)), true},
+		{"other user", sign("8", "id", "family", now.Add(-10*time.Second)), true},
+		{"invalid subject", sign("0", "id", "family", now), false},
+	}
+	for _, tt := range tests {
+		user, _, err := app.verifyAccessToken(tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+		if err == nil && user.ID < 1 {
+			t.Errorf("%s: user ID %d", tt.name, user.ID)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The headers which trusted proxies can use to report the client's address, as
+// selected by the -trusted-proxy-header flag.
+const (
+	proxyHeaderXFF       = "x-forwarded-for"
+	proxyHeaderForwarded = "forwarded"
+)
+
+// The realIP() middleware resolves the client's IP address once, at the start of the
+// request, and stores it in the request context for the rate limiter, logging and
+// session tracking.
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.contextSetClientIP(r, app.resolveClientIP(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseTrustedProxies parses a space-separated list of CIDR ranges (or single IP
+// addresses) of the reverse proxies which we trust to report the client's address.
+func parseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, field := range strings.Fields(s) {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q", field)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// The trustedProxy() helper reports whether an address is one of our trusted proxies.
+func (app *application) trustedProxy(ip net.IP) bool {
+	for _, ipNet := range app.config.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The resolveClientIP() helper works out the IP address of the client which made the
+// request. If the connection comes from a trusted proxy, the addresses which the
+// proxies have recorded in the configured header (X-Forwarded-For, or Forwarded from
+// RFC 7239) are checked from right to left: the rightmost address which isn't a
+// trusted proxy is the client. Anything to the left of it could have been sent by the
+// client, so it isn't trusted. Only the configured header is read, as a proxy which
+// writes one of them passes the other through from the client unchanged. If every
+// address is a trusted proxy, the leftmost one is used. Malformed or obfuscated
+// entries stop the search, and the last trusted address is used instead.
+func (app *application) resolveClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	if remote == nil || !app.trustedProxy(remote) {
+		return host
+	}
+
+	var hops []string
+	switch app.config.trustedProxyHeader {
+	case proxyHeaderForwarded:
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	default:
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			break
+		}
+		client = ip
+		if !app.trustedProxy(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor returns the for= parameters of the elements of the Forwarded header
+// lines, in order. Elements without a for= parameter are returned as empty strings, so
+// that they stop the search in resolveClientIP().
+func forwardedFor(lines []string) []string {
+	var hops []string
+	for _, line := range lines {
+		for _, element := range splitQuoted(line, ',') {
+			hop := ""
+			for _, pair := range splitQuoted(element, ';') {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hop = strings.Trim(kv[1], `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s on sep, except where sep appears inside a quoted string.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseHop parses an address from X-Forwarded-For or a Forwarded for= parameter, which
+// may include a port, and for IPv6 may be in brackets. It returns nil for anything
+// else, including the "unknown" and obfuscated identifiers allowed by RFC 7239.
+func parseHop(hop string) net.IP {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	return net.ParseIP(hop)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		header    string
+		remote    string
+		xff       []string
+		forwarded []string
+		want      string
+	}{
+		{name: "untrusted remote ignores headers", remote: "203.0.113.7:5000", xff: []string{"6.6.6.6"}, want: "203.0.113.7"},
+		{name: "trusted remote without header", remote: "10.0.0.1:5000", want: "10.0.0.1"},
+		{name: "single hop", remote: "10.0.0.1:5000", xff: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "spoofed leftmost xff", remote: "10.0.0.1:5000", xff: []string{"6.6.6.6, 203.0.113.9"}, want: "203.0.113.9"},
+		{name: "spoofed xff across header lines", remote: "10.0.0.1:5000", xff: []string{"6.6.6.6", "203.0.113.9, 10.0.0.2"}, want: "203.0.113.9"},
+		{name: "spoofed forwarded ignored in xff mode", remote: "10.0.0.1:5000", forwarded: []string{"for=6.6.6.6"}, xff: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "spoofed xff ignored in forwarded mode", header: proxyHeaderForwarded, remote: "10.0.0.1:5000", forwarded: []string{"for=203.0.113.9"}, xff: []string{"6.6.6.6"}, want: "203.0.113.9"},
+		{name: "spoofed leftmost forwarded", header: proxyHeaderForwarded, remote: "10.0.0.1:5000", forwarded: []string{`for=6.6.6.6, for="203.0.113.9:4711";proto=https`}, want: "203.0.113.9"},
+		{name: "forwarded ipv6", header: proxyHeaderForwarded, remote: "10.0.0.1:5000", forwarded: []string{`for="[2001:db8::9]:4711"`}, want: "2001:db8::9"},
+		{name: "malformed xff hop", remote: "10.0.0.1:5000", xff: []string{"203.0.113.9, garbage"}, want: "10.0.0.1"},
+		{name: "malformed hop behind trusted proxy", remote: "10.0.0.1:5000", xff: []string{"garbage, 10.0.0.2"}, want: "10.0.0.2"},
+		{name: "obfuscated forwarded", header: proxyHeaderForwarded, remote: "10.0.0.1:5000", forwarded: []string{"for=_hidden"}, want: "10.0.0.1"},
+		{name: "forwarded element without for", header: proxyHeaderForwarded, remote: "10.0.0.1:5000", forwarded: []string{"for=203.0.113.9, proto=https"}, want: "10.0.0.1"},
+		{name: "all trusted", remote: "10.0.0.1:5000", xff: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "trusted ipv6 proxy", remote: "[2001:db8::1]:5000", xff: []string{"203.0.113.9"}, want: "203.0.113.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{}
+			app.config.trustedProxies = proxies
+			app.config.trustedProxyHeader = tt.header
+			if app.config.trustedProxyHeader == "" {
+				app.config.trustedProxyHeader = proxyHeaderXFF
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			for _, v := range tt.forwarded {
+				r.Header.Add("Forwarded", v)
+			}
+
+			if got := app.resolveClientIP(r); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, s := range []string{"not-an-ip", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
@@ -5,13 +5,27 @@ import (
 	"net/http"
 
 	"github.com/shakilbd009/go-greenlight-api/internal/data"
+	"github.com/shakilbd009/go-greenlight-api/internal/jwt"
 )
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey   = contextKey("user")
+	tokenContextKey  = contextKey("token")
+	claimsContextKey = contextKey("claims")
+	apiKeyContextKey = contextKey("apiKey")
+	limitContextKey  = contextKey("permissionLimit")
+	ipContextKey     = contextKey("clientIP")
+	infoContextKey   = contextKey("requestInfo")
+)
 
+// The contextSetUser() helper stores the user which made the request. The user's ID is
+// also recorded for the access log.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	if info := app.contextGetRequestInfo(r); info != nil {
+		info.userID = user.ID
+	}
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -26,3 +40,97 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The contextSetToken() helper stores the plaintext authentication token which the
+// request was authenticated with, so that handlers can act on the current session.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() helper returns the authentication token stored by
+// contextSetToken(), or the empty string for anonymous requests.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// The contextSetClaims() helper stores the claims of a verified JWT. It is only used in
+// JWT auth mode.
+func (app *application) contextSetClaims(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// The contextGetClaims() helper returns the JWT claims stored by contextSetClaims(), or
+// nil if the request wasn't authenticated with a JWT.
+func (app *application) contextGetClaims(r *http.Request) *jwt.Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	return claims
+}
+
+// The contextSetAPIKey() helper stores the API key which the request was authenticated
+// with.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey() helper returns the API key stored by contextSetAPIKey(), or
+// nil if the request wasn't authenticated with an API key.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// The contextSetPermissionLimit() helper stores the permissions which a delegated
+// credential (an API key or an OAuth access token) is limited to. The request can only
+// use permissions which both the user and the credential have.
+func (app *application) contextSetPermissionLimit(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), limitContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// The contextGetPermissionLimit() helper returns the permissions stored by
+// contextSetPermissionLimit(), or nil if the request isn't limited.
+func (app *application) contextGetPermissionLimit(r *http.Request) data.Permissions {
+	permissions, _ := r.Context().Value(limitContextKey).(data.Permissions)
+	return permissions
+}
+
+// The contextSetClientIP() helper stores the client IP address resolved by the realIP()
+// middleware.
+func (app *application) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), ipContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+// The contextGetClientIP() helper returns the IP address stored by contextSetClientIP(),
+// or the empty string if there isn't one.
+func (app *application) contextGetClientIP(r *http.Request) string {
+	ip, _ := r.Context().Value(ipContextKey).(string)
+	return ip
+}
+
+// The contextSetRequestInfo() helper stores the requestInfo created by the requestID()
+// middleware.
+func (app *application) contextSetRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), infoContextKey, info)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestInfo() helper returns the requestInfo stored by
+// contextSetRequestInfo(), or nil if there isn't one.
+func (app *application) contextGetRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(infoContextKey).(*requestInfo)
+	return info
+}
+
+// The contextGetRequestID() helper returns the ID of the request, or the empty string
+// if it doesn't have one.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	if info := app.contextGetRequestInfo(r); info != nil {
+		return info.id
+	}
+	return ""
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// corsPolicy sets which cross-origin requests are allowed for a group of routes: those
+// whose path starts with Prefix. Origins can be exact origins such as
+// "https://www.example.com", wildcard subdomain patterns such as
+// "https://*.example.com" (which match any subdomain, at any depth, but not
+// example.com itself), or "*" to allow any origin.
+type corsPolicy struct {
+	Name           string   `json:"name"`
+	Prefix         string   `json:"prefix"`
+	Origins        []string `json:"origins"`
+	Methods        []string `json:"methods"`
+	AllowedHeaders []string `json:"allowed_headers"`
+	ExposedHeaders []string `json:"exposed_headers"`
+	// MaxAge is how long browsers can cache the result of a preflight request, in
+	// seconds. Zero leaves it to the browser's default (5 seconds in most browsers).
+	MaxAge int `json:"max_age"`
+	// Credentials allows browsers to send cookies and HTTP authentication with the
+	// request, and to expose the response to scripts.
+	Credentials bool `json:"credentials"`
+}
+
+func (p *corsPolicy) validate() error {
+	if p.Name == "" {
+		return errors.New("CORS policy name must be provided")
+	}
+	if p.Name != "default" && !strings.HasPrefix(p.Prefix, "/") {
+		return fmt.Errorf("CORS policy %q: prefix must start with /", p.Name)
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("CORS policy %q: max_age must not be negative", p.Name)
+	}
+	for _, origin := range p.Origins {
+		if origin == "*" {
+			if p.Credentials {
+				return fmt.Errorf("CORS policy %q: credentials can't be allowed for any origin", p.Name)
+			}
+			continue
+		}
+		i := strings.Index(origin, "://")
+		if i <= 0 || strings.Contains(origin[i+3:], "/") {
+			return fmt.Errorf("CORS policy %q: invalid origin %q", p.Name, origin)
+		}
+		if host := origin[i+3:]; strings.Contains(host, "*") && (!strings.HasPrefix(host, "*.") || strings.Count(host, "*") > 1) {
+			return fmt.Errorf("CORS policy %q: wildcards are only allowed as the first label of the host, as in https://*.example.com", p.Name)
+		}
+	}
+	for i := range p.Methods {
+		p.Methods[i] = strings.ToUpper(p.Methods[i])
+	}
+	return nil
+}
+
+// allowsOrigin reports whether the value of a request's Origin header matches one of
+// the policy's origins. Origins are compared case-insensitively, and the scheme and
+// port must match exactly.
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range p.Origins {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == "*":
+			return true
+		case strings.Contains(pattern, "://*."):
+			// The pattern is split around the *, and the origin must start and end
+			// with the two halves. The part in between must be a non-empty host name,
+			// so it can't contain a scheme, port or path.
+			parts := strings.SplitN(pattern, "*", 2)
+			if len(origin) > len(parts[0])+len(parts[1]) && strings.HasPrefix(origin, parts[0]) && strings.HasSuffix(origin, parts[1]) {
+				if sub := origin[len(parts[0]) : len(origin)-len(parts[1])]; !strings.ContainsAny(sub, ":/@") {
+					return true
+				}
+			}
+		case pattern == origin:
+			return true
+		}
+	}
+	return false
+}
+
+// corsListFlag parses a space or comma separated list of values, as used by the
+// -cors-* flags.
+func corsListFlag(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+}
+
+// loadCORSConfig reads CORS settings from a JSON file. The file can set the default
+// policy, which applies to requests that don't match any of the other policies, and
+// the list of per-route policies:
+//
+//	{
+//		"default": {"origins": ["https://*.example.com"], "methods": ["GET", "POST"]},
+//		"policies": [
+//			{"name": "oauth", "prefix": "/oauth/", "origins": ["*"], "methods": ["GET", "POST"]}
+//		]
+//	}
+//
+// If the default is left out, the -cors-* flags are used.
+func loadCORSConfig(path string) (*corsPolicy, []corsPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var file struct {
+		Default  *corsPolicy  `json:"default"`
+		Policies []corsPolicy `json:"policies"`
+	}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Default != nil {
+		file.Default.Name, file.Default.Prefix = "default", ""
+		if err := file.Default.validate(); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for i := range file.Policies {
+		if err := file.Policies[i].validate(); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return file.Default, file.Policies, nil
+}
+
+// The corsPolicyFor() helper returns the first policy whose prefix matches the request
+// path, or the default policy.
+func (app *application) corsPolicyFor(r *http.Request) *corsPolicy {
+	for i := range app.config.cors.policies {
+		if strings.HasPrefix(r.URL.Path, app.config.cors.policies[i].Prefix) {
+			return &app.config.cors.policies[i]
+		}
+	}
+	return &app.config.cors.defaultPolicy
+}
+
+// The setCORSHeaders() helper adds the CORS headers which allow a request from origin.
+// For preflight requests, it also describes which methods and headers may be used, and
+// for how long the browser can cache that.
+func setCORSHeaders(w http.ResponseWriter, policy *corsPolicy, origin string, preflight bool) {
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if policy.Credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(policy.ExposedHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+		}
+		return
+	}
+	if len(policy.Methods) > 0 {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+	}
+	if len(policy.AllowedHeaders) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+	}
+	if policy.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+	}
+}
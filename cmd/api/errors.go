@@ -1,8 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/jwt"
 )
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
@@ -19,6 +25,8 @@ func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
+		"remote_ip":      app.clientIP(r),
+		"request_id":     app.contextGetRequestID(r),
 	})
 }
 
@@ -28,6 +36,10 @@ func (app *application) logError(r *http.Request, err error) {
 // more flexibility over the values that we can include in the response.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
 	env := envelope{"error": message}
+	// Include the request ID, so that clients can quote it when reporting a problem.
+	if id := app.contextGetRequestID(r); id != "" {
+		env["request_id"] = id
+	}
 	// Write the response using the writeJSON() helper. If this happens to return an
 	// error then log it, and fall back to sending the client an empty response with a
 	// 500 Internal Server Error status code.
@@ -78,11 +90,11 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
-func (app application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
+func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	app.errorResponse(w, r, http.StatusUnauthorized, "invalid authentication credentials")
 }
 
-func (app application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WW-Authenticate", "Bearer")
 	app.errorResponse(w, r, http.StatusUnauthorized, "invalid or missing authentication token")
 }
@@ -100,3 +112,58 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// The currentUserErrorResponse() method sends the response for an error returned by the
+// currentUser() helper.
+func (app *application) currentUserErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, jwt.ErrInvalidToken) {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	app.serverErrorResponse(w, r, err)
+}
+
+// The loginThrottledResponse() method is used when password logins are temporarily
+// blocked for an account or IP address after repeated failures.
+func (app *application) loginThrottledResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// The magicLinkThrottledResponse() method is used when too many login links have been
+// requested for an email address.
+func (app *application) magicLinkThrottledResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	message := "too many login links requested for this email address, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+func (app *application) mfaRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must enable two-factor authentication to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// The oauthErrorResponse() method sends an error from the OAuth token endpoint. These
+// use the format defined in RFC 6749 section 5.2, with an error code which clients can
+// act on, rather than our usual error envelope.
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	if status == http.StatusUnauthorized {
+		headers.Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	env := envelope{"error": code, "error_description": description}
+	if id := app.contextGetRequestID(r); id != "" {
+		env["request_id"] = id
+	}
+	if err := app.writeJSON(w, status, env, headers); err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (app *application) delegatedCredentialResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key or OAuth access token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
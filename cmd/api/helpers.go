@@ -16,7 +16,7 @@ import (
 
 type envelope map[string]interface{}
 
-func (app application) background(fn func()) {
+func (app *application) background(fn func()) {
 	app.wg.Add(1)
 	go func() {
 		defer app.wg.Done()
@@ -34,10 +34,16 @@ func (app application) background(fn func()) {
 // Retrieve the "id" URL parameter from the current request context, then convert it to
 // an integer and return it. If the operation isn't successful, return 0 and an error.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readNamedIDParam(r, "id")
+}
+
+// The readNamedIDParam() helper works in the same way as readIDParam(), but for routes
+// which contain more than one ID parameter (like "/v1/movies/:id/reviews/:review_id").
+func (app *application) readNamedIDParam(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 
 	return id, nil
@@ -186,3 +192,12 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 
 }
+
+// The clientIP() helper returns the IP address of the client which made the request,
+// as resolved by the realIP() middleware, taking trusted proxies into account.
+func (app *application) clientIP(r *http.Request) string {
+	if ip := app.contextGetClientIP(r); ip != "" {
+		return ip
+	}
+	return app.resolveClientIP(r)
+}
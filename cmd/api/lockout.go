@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/data"
+)
+
+// The loginAllowed() helper claims a password login attempt for the given email
+// address. The attempt is counted against both the account and the client's IP address
+// before the password is checked, so that concurrent requests can't all slip through
+// before the first failure is recorded. If the account or IP address is locked out, or
+// the delay after the previous attempt hasn't passed yet, it sends a 429 Too Many
+// Requests response and returns false. A successful login must call loginSucceeded().
+func (app *application) loginAllowed(w http.ResponseWriter, r *http.Request, email string) bool {
+	retryAt, err := app.models.LoginFailures.Reserve(data.LoginScopeIP, app.clientIP(r), app.loginPolicy(app.config.lockout.ipThreshold))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if retryAt.IsZero() {
+		retryAt, err = app.models.LoginFailures.Reserve(data.LoginScopeAccount, strings.ToLower(email), app.loginPolicy(app.config.lockout.threshold))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+		// The attempt won't be made after all, so don't count it against the IP address.
+		if !retryAt.IsZero() {
+			if err := app.models.LoginFailures.Release(data.LoginScopeIP, app.clientIP(r)); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return false
+			}
+		}
+	}
+	if !retryAt.IsZero() {
+		app.loginThrottledResponse(w, r, time.Until(retryAt))
+		return false
+	}
+	return true
+}
+
+// The loginSucceeded() helper gives back the attempt claimed by loginAllowed() after a
+// successful login. The account's failure count is reset, but the count for the IP
+// address is left as it was, otherwise an attacker could reset it by logging in to
+// their own account between guesses.
+func (app *application) loginSucceeded(r *http.Request, email string) error {
+	if err := app.models.LoginFailures.Clear(data.LoginScopeAccount, strings.ToLower(email)); err != nil {
+		return err
+	}
+	return app.models.LoginFailures.Release(data.LoginScopeIP, app.clientIP(r))
+}
+
+// The loginPolicy() helper returns the lockout policy for the given threshold.
+func (app *application) loginPolicy(threshold int) data.LoginPolicy {
+	return data.LoginPolicy{
+		Threshold:       threshold,
+		Window:          app.config.lockout.window,
+		LockoutDuration: app.config.lockout.duration,
+		Delay:           app.config.lockout.delay,
+		MaxDelay:        app.config.lockout.maxDelay,
+	}
+}
+
+// The recordLoginFailure() helper is called when an attempt claimed by loginAllowed()
+// fails. The failure has already been counted, so this only locks the account and the
+// client's IP address out if they have reached their thresholds. If this locks the
+// account, its owner is emailed (user is nil when there is no account with the email
+// address).
+func (app *application) recordLoginFailure(r *http.Request, email string, user *data.User) error {
+	account, newlyLocked, err := app.models.LoginFailures.Lock(data.LoginScopeAccount, strings.ToLower(email), app.loginPolicy(app.config.lockout.threshold))
+	if err != nil {
+		return err
+	}
+	if _, _, err := app.models.LoginFailures.Lock(data.LoginScopeIP, app.clientIP(r), app.loginPolicy(app.config.lockout.ipThreshold)); err != nil {
+		return err
+	}
+
+	if newlyLocked && user != nil {
+		app.logger.PrintInfo("account locked after failed logins", map[string]string{
+			"user_id": fmt.Sprint(user.ID),
+			"ip":      app.clientIP(r),
+		})
+		// The failure count is formatted as a string, as the payload is stored as JSON
+		// and a number would come back as a float64.
+		payload := map[string]interface{}{
+			"failures":    strconv.Itoa(account.Failures),
+			"lockedUntil": account.LockedUntil.UTC().Format(time.RFC1123),
+			"ip":          app.clientIP(r),
+		}
+		if err := app.enqueueEmail(user.Email, "account_locked.tmpl", payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/data"
+)
+
+// The enqueueEmail() helper persists an outbound email in the email_jobs table. Handlers
+// call this before sending their response, so that once the client has seen a 202
+// Accepted the email is guaranteed to be delivered (or to have its failure recorded)
+// even if the process crashes or the SMTP server is unavailable.
+func (app *application) enqueueEmail(recipient, templateFile string, payload map[string]interface{}) error {
+	job := &data.EmailJob{
+		Recipient:   recipient,
+		Template:    templateFile,
+		Data:        payload,
+		MaxAttempts: app.config.mailQueue.maxAttempts,
+	}
+	return app.models.EmailJobs.Insert(job)
+}
+
+// runMailQueue() starts the pool of workers which deliver queued emails. The workers are
+// tracked by the application wait group, and stop claiming new jobs as soon as ctx is
+// cancelled. Any job which is already being delivered is allowed to finish, so that
+// serve() can drain the pool cleanly during a graceful shutdown.
+func (app *application) runMailQueue(ctx context.Context) {
+	for i := 1; i <= app.config.mailQueue.workers; i++ {
+		worker := i
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			app.mailWorker(ctx, worker)
+		}()
+	}
+	app.logger.PrintInfo("started mail queue", map[string]string{
+		"workers": strconv.Itoa(app.config.mailQueue.workers),
+	})
+}
+
+func (app *application) mailWorker(ctx context.Context, worker int) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		// Claim a single job at a time. Any other jobs which are due stay in the queue
+		// for the other workers to pick up.
+		jobs, err := app.models.EmailJobs.Claim(1, app.config.mailQueue.staleAfter)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"worker": strconv.Itoa(worker)})
+		}
+		if err != nil || len(jobs) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(app.config.mailQueue.pollInterval):
+			}
+			continue
+		}
+
+		for _, job := range jobs {
+			app.deliverEmail(job)
+		}
+	}
+}
+
+// deliverEmail() sends a single claimed job and records the outcome. Failed attempts are
+// rescheduled with an exponential backoff until the job runs out of attempts.
+func (app *application) deliverEmail(job *data.EmailJob) {
+	properties := map[string]string{
+		"email_job_id": strconv.FormatInt(job.ID, 10),
+		"template":     job.Template,
+		"attempt":      strconv.Itoa(job.Attempts),
+	}
+
+	sendErr := app.mailer.Send(job.Recipient, job.Template, job.Data)
+	if sendErr == nil {
+		if err := app.models.EmailJobs.MarkSent(job.ID); err != nil {
+			app.logger.PrintError(err, properties)
+		}
+		return
+	}
+
+	app.logger.PrintError(sendErr, properties)
+	runAt := time.Now().Add(app.mailBackoff(job.Attempts))
+	if err := app.models.EmailJobs.MarkFailed(job, sendErr, runAt); err != nil {
+		app.logger.PrintError(err, properties)
+		return
+	}
+	if job.Status == data.EmailJobFailed {
+		app.logger.PrintInfo("giving up on email job", properties)
+	}
+}
+
+// mailBackoff() returns how long to wait before retrying a job which has failed attempts
+// times. The delay doubles after each attempt and is capped at one hour.
+func (app *application) mailBackoff(attempts int) time.Duration {
+	delay := app.config.mailQueue.backoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= time.Hour {
+			return time.Hour
+		}
+	}
+	return delay
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
 	"expvar"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"runtime"
 	"strings"
@@ -16,7 +18,9 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/shakilbd009/go-greenlight-api/internal/data"
 	"github.com/shakilbd009/go-greenlight-api/internal/jsonlog"
+	"github.com/shakilbd009/go-greenlight-api/internal/jwt"
 	"github.com/shakilbd009/go-greenlight-api/internal/mailer"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Create a buildTime variable to hold the executable binary build time. Note that this
@@ -42,10 +46,18 @@ type config struct {
 	// Add a new limiter struct containing fields for the requests-per-second and burst
 	// values, and a boolean field which we can use to enable/disable rate limiting
 	// altogether.
+	// The rps and burst values are the default limit, for routes which don't match any
+	// of the policies. ipRPS and ipBurst are a coarse limit for each client IP address,
+	// applied before authentication so that guessing credentials is throttled too.
 	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
+		rps        float64
+		burst      int
+		ipRPS      float64
+		ipBurst    int
+		enabled    bool
+		policies   []rateLimitPolicy
+		configFile string
+		store      string
 	}
 
 	smtp struct {
@@ -55,8 +67,89 @@ type config struct {
 		password string
 		sender   string
 	}
+	// The cors struct holds the CORS policies. defaultPolicy is built from the -cors-*
+	// flags (or the config file) and applies to any route which doesn't match one of
+	// the per-route policies.
 	cors struct {
-		trustedOrigins []string
+		defaultPolicy corsPolicy
+		policies      []corsPolicy
+		configFile    string
+	}
+	// The auth struct holds the settings for authentication and authorization.
+	// The mode field selects how authentication tokens work: authModeToken stores them
+	// in the tokens table, while authModeJWT issues signed tokens which are checked
+	// without touching the database.
+	auth struct {
+		defaultRole string
+		accessTTL   time.Duration
+		refreshTTL  time.Duration
+		mode        string
+		jwtAlg      string
+		// mfaRequired lists the permission codes which can only be used by users with
+		// two-factor authentication enabled.
+		mfaRequired []string
+	}
+	// The oauth struct holds the lifetimes of the authorization codes and access tokens
+	// issued by the OAuth2 authorization server.
+	oauth struct {
+		codeTTL  time.Duration
+		tokenTTL time.Duration
+	}
+	// The lockout struct holds the brute-force protection settings for password logins.
+	// Failed logins are counted per account and per IP address; each failure doubles the
+	// delay before the next attempt is allowed (starting at delay, up to maxDelay), and
+	// reaching the threshold locks logins out for duration.
+	lockout struct {
+		threshold   int
+		ipThreshold int
+		window      time.Duration
+		duration    time.Duration
+		delay       time.Duration
+		maxDelay    time.Duration
+	}
+	// The passwords struct selects the algorithm used to hash new passwords, along with
+	// its cost parameters. Existing hashes made with other settings still work, and are
+	// upgraded when their owner next logs in.
+	passwords struct {
+		hasher            string
+		bcryptCost        int
+		argon2Memory      uint
+		argon2Iterations  uint
+		argon2Parallelism uint
+	}
+	// The passwordPolicy struct holds the rules for new passwords. breachedFile is the
+	// path to a list of SHA-1 prefixes of breached passwords; no list is checked if it
+	// is empty.
+	passwordPolicy struct {
+		minLength    int
+		minClasses   int
+		minScore     int
+		breachedFile string
+	}
+	// The trustedProxies field lists the reverse proxies whose forwarding header is used
+	// to find the client's IP address. trustedProxyHeader is the header which those
+	// proxies write (proxyHeaderXFF or proxyHeaderForwarded); the other one is ignored,
+	// as a proxy passes it through from the client unchanged.
+	trustedProxies     []*net.IPNet
+	trustedProxyHeader string
+	// The magicLink struct limits how many login links can be requested for an email
+	// address within each window.
+	magicLink struct {
+		limit  int
+		window time.Duration
+	}
+	// The cursor struct holds the secret key used to sign keyset pagination cursors.
+	cursor struct {
+		secret []byte
+	}
+	// The mailQueue struct holds the settings for the pool of workers which deliver
+	// emails from the email_jobs table.
+	mailQueue struct {
+		workers      int
+		pollInterval time.Duration
+		staleAfter   time.Duration
+		backoff      time.Duration
+		maxAttempts  int
 	}
 }
 
@@ -69,12 +162,32 @@ type application struct {
 	models data.Models
 	mailer mailer.Mailer
 	wg     sync.WaitGroup
+	// limiter holds the rate limit state, selected by the -limiter-store flag.
+	limiter rateLimitStore
+	// prom holds the metrics served at /metrics.
+	prom *promMetrics
+	// The jwtKeys and jwtRevoked fields are only set when using authModeJWT.
+	jwtKeys    *jwt.KeySet
+	jwtRevoked *jwt.RevocationList
 }
 
+// Define the supported authentication modes.
+const (
+	authModeToken = "token"
+	authModeJWT   = "jwt"
+)
+
 func main() {
 	// Declare an instance of the config struct.
 	var cfg config
 	var ori string
+	var corsMethods, corsAllowedHeaders, corsExposedHeaders string
+	var corsMaxAge time.Duration
+	var cursorSecret string
+	var jwtKeys string
+	var mfaRequired string
+	var limiterPolicies rateLimitPolicyFlag
+	var trustedProxies string
 	// Read the value of the port and env command-line flags into the config struct. We
 	// default to using the port number 4000 and the environment "development" if no
 	// corresponding flags are provided.
@@ -93,6 +206,11 @@ func main() {
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.Float64Var(&cfg.limiter.ipRPS, "limiter-ip-rps", 10, "Maximum requests per second from each IP address, before authentication (0 to disable)")
+	flag.IntVar(&cfg.limiter.ipBurst, "limiter-ip-burst", 20, "Maximum burst of requests from each IP address, before authentication")
+	flag.StringVar(&cfg.limiter.store, "limiter-store", "memory", "Rate limiter store (memory|postgres); use postgres to share limits between instances")
+	flag.Var(&limiterPolicies, "limiter-policy", "Rate limit policy as name:methods:prefix:rps:burst (repeatable; replaces the built-in policies)")
+	flag.StringVar(&cfg.limiter.configFile, "limiter-config", "", "JSON file of rate limit policies (overrides -limiter-policy)")
 	// Read the SMTP server configuration settings into the config struct, using the
 	// Mailtrap settings as the default values. IMPORTANT: If you're following along,
 	// make sure to replace the default values for smtp-username and smtp-password
@@ -102,7 +220,47 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.alexedwards.net>", "SMTP sender")
-	flag.StringVar(&ori, "cors-trusted-origins", "", "Trusted CORS origins (space separated)")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "Trusted reverse proxy CIDR ranges or addresses (space separated)")
+	flag.StringVar(&cfg.trustedProxyHeader, "trusted-proxy-header", proxyHeaderXFF, "Header which the trusted proxies write the client address to (x-forwarded-for|forwarded)")
+	flag.StringVar(&ori, "cors-trusted-origins", "", "Trusted CORS origins, which may use wildcard subdomains such as https://*.example.com (space separated)")
+	flag.StringVar(&corsMethods, "cors-allowed-methods", "GET POST PUT PATCH DELETE", "Methods allowed in cross-origin requests (space separated)")
+	flag.StringVar(&corsAllowedHeaders, "cors-allowed-headers", "Authorization Content-Type", "Request headers allowed in cross-origin requests (space separated)")
+	flag.StringVar(&corsExposedHeaders, "cors-exposed-headers", "", "Response headers exposed to cross-origin scripts (space separated)")
+	flag.DurationVar(&corsMaxAge, "cors-max-age", 0, "How long browsers may cache preflight responses (0 for the browser default)")
+	flag.BoolVar(&cfg.cors.defaultPolicy.Credentials, "cors-allow-credentials", false, "Allow credentials in cross-origin requests")
+	flag.StringVar(&cfg.cors.configFile, "cors-config", "", "JSON file of CORS policies (overrides the other -cors-* flags)")
+	flag.StringVar(&cfg.auth.defaultRole, "default-role", "viewer", "Role granted to newly registered users")
+	flag.DurationVar(&cfg.auth.accessTTL, "auth-access-ttl", 15*time.Minute, "Lifetime of authentication (access) tokens")
+	flag.DurationVar(&cfg.auth.refreshTTL, "auth-refresh-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.StringVar(&cfg.auth.mode, "auth-mode", authModeToken, "Authentication token mode (token|jwt)")
+	flag.StringVar(&cfg.auth.jwtAlg, "jwt-alg", jwt.AlgHS256, "JWT signing algorithm (HS256|EdDSA)")
+	flag.StringVar(&mfaRequired, "mfa-required-permissions", "movies:write", "Permissions which require two-factor authentication (space separated)")
+	flag.StringVar(&jwtKeys, "jwt-keys", "", "JWT signing keys as space separated kid:base64key pairs; the first signs new tokens (random if not set)")
+	flag.DurationVar(&cfg.oauth.codeTTL, "oauth-code-ttl", 10*time.Minute, "Lifetime of OAuth authorization codes")
+	flag.DurationVar(&cfg.oauth.tokenTTL, "oauth-token-ttl", time.Hour, "Lifetime of OAuth access tokens")
+	flag.IntVar(&cfg.lockout.threshold, "lockout-threshold", 5, "Failed logins for an account before it is locked (0 to disable)")
+	flag.IntVar(&cfg.lockout.ipThreshold, "lockout-ip-threshold", 20, "Failed logins from an IP address before it is locked (0 to disable)")
+	flag.DurationVar(&cfg.lockout.window, "lockout-window", 15*time.Minute, "Period over which failed logins are counted")
+	flag.DurationVar(&cfg.lockout.duration, "lockout-duration", 15*time.Minute, "How long a lockout lasts")
+	flag.DurationVar(&cfg.lockout.delay, "lockout-delay", time.Second, "Delay enforced after the first failed login (doubles after each failure)")
+	flag.DurationVar(&cfg.lockout.maxDelay, "lockout-max-delay", 30*time.Second, "Maximum delay enforced between failed logins")
+	flag.StringVar(&cfg.passwords.hasher, "password-hasher", "argon2id", "Password hashing algorithm (argon2id|bcrypt)")
+	flag.IntVar(&cfg.passwords.bcryptCost, "bcrypt-cost", 12, "Bcrypt cost factor")
+	flag.UintVar(&cfg.passwords.argon2Memory, "argon2-memory", 64*1024, "Argon2id memory in KiB")
+	flag.UintVar(&cfg.passwords.argon2Iterations, "argon2-iterations", 3, "Argon2id iterations")
+	flag.UintVar(&cfg.passwords.argon2Parallelism, "argon2-parallelism", 2, "Argon2id parallelism")
+	flag.IntVar(&cfg.passwordPolicy.minLength, "password-min-length", 8, "Minimum length of new passwords in characters")
+	flag.IntVar(&cfg.passwordPolicy.minClasses, "password-min-classes", 1, "Character classes (lowercase, uppercase, digits, symbols) new passwords must use")
+	flag.IntVar(&cfg.passwordPolicy.minScore, "password-min-score", 2, "Minimum strength score (0-4) of new passwords")
+	flag.StringVar(&cfg.passwordPolicy.breachedFile, "password-breached-file", "", "File of SHA-1 prefixes of breached passwords, one per line")
+	flag.IntVar(&cfg.magicLink.limit, "magic-link-limit", 3, "Maximum login links sent to an email address per window (0 to disable)")
+	flag.DurationVar(&cfg.magicLink.window, "magic-link-window", 15*time.Minute, "Period over which login link requests are counted")
+	flag.StringVar(&cursorSecret, "cursor-secret", "", "Secret key for signing pagination cursors (random if not set)")
+	flag.IntVar(&cfg.mailQueue.workers, "mail-workers", 2, "Number of email queue workers")
+	flag.DurationVar(&cfg.mailQueue.pollInterval, "mail-poll-interval", 5*time.Second, "Email queue poll interval")
+	flag.DurationVar(&cfg.mailQueue.staleAfter, "mail-stale-after", 5*time.Minute, "Reclaim email jobs locked for longer than this")
+	flag.DurationVar(&cfg.mailQueue.backoff, "mail-backoff", 30*time.Second, "Initial email retry backoff (doubles after each attempt)")
+	flag.IntVar(&cfg.mailQueue.maxAttempts, "mail-max-attempts", 8, "Maximum email delivery attempts")
 
 	// Create a new version boolean flag with the default value of false.
 	displayVersion := flag.Bool("version", false, "Display version and exit")
@@ -115,7 +273,118 @@ func main() {
 		fmt.Printf("Build time:\t%s\n", buildTime)
 		os.Exit(0)
 	}
-	cfg.cors.trustedOrigins = strings.Fields(ori)
+	cfg.cors.defaultPolicy.Name = "default"
+	cfg.cors.defaultPolicy.Origins = corsListFlag(ori)
+	cfg.cors.defaultPolicy.Methods = corsListFlag(corsMethods)
+	cfg.cors.defaultPolicy.AllowedHeaders = corsListFlag(corsAllowedHeaders)
+	cfg.cors.defaultPolicy.ExposedHeaders = corsListFlag(corsExposedHeaders)
+	cfg.cors.defaultPolicy.MaxAge = int(corsMaxAge / time.Second)
+	if err := cfg.cors.defaultPolicy.validate(); err != nil {
+		log.Fatalln(err)
+	}
+	if cfg.cors.configFile != "" {
+		def, policies, err := loadCORSConfig(cfg.cors.configFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if def != nil {
+			cfg.cors.defaultPolicy = *def
+		}
+		cfg.cors.policies = policies
+	}
+	cfg.auth.mfaRequired = strings.Fields(mfaRequired)
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cfg.trustedProxies = proxies
+	cfg.trustedProxyHeader = strings.ToLower(cfg.trustedProxyHeader)
+	if cfg.trustedProxyHeader != proxyHeaderXFF && cfg.trustedProxyHeader != proxyHeaderForwarded {
+		log.Fatalf("invalid trusted proxy header %q", cfg.trustedProxyHeader)
+	}
+	// If no cursor secret was provided, generate a random one. This is fine for a single
+	// instance, but cursors will stop working after a restart, and won't be accepted by
+	// other instances, so a shared secret should be set in production.
+	if cursorSecret == "" {
+		cfg.cursor.secret = make([]byte, 32)
+		if _, err := rand.Read(cfg.cursor.secret); err != nil {
+			log.Fatalln(err)
+		}
+		logger.PrintInfo("using a random pagination cursor secret", nil)
+	} else {
+		cfg.cursor.secret = []byte(cursorSecret)
+	}
+	switch cfg.passwords.hasher {
+	case "argon2id":
+		if cfg.passwords.argon2Memory < 8*cfg.passwords.argon2Parallelism || cfg.passwords.argon2Iterations < 1 ||
+			cfg.passwords.argon2Parallelism < 1 || cfg.passwords.argon2Parallelism > 255 {
+			log.Fatalln("invalid argon2id parameters")
+		}
+		hasher := data.DefaultArgon2idHasher()
+		hasher.Memory = uint32(cfg.passwords.argon2Memory)
+		hasher.Iterations = uint32(cfg.passwords.argon2Iterations)
+		hasher.Parallelism = uint8(cfg.passwords.argon2Parallelism)
+		data.SetPasswordHasher(hasher)
+	case "bcrypt":
+		if cfg.passwords.bcryptCost < bcrypt.MinCost || cfg.passwords.bcryptCost > bcrypt.MaxCost {
+			log.Fatalf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		data.SetPasswordHasher(&data.BcryptHasher{Cost: cfg.passwords.bcryptCost})
+	default:
+		log.Fatalf("invalid password hasher %q", cfg.passwords.hasher)
+	}
+	if cfg.limiter.ipRPS > 0 && cfg.limiter.ipBurst < 1 {
+		log.Fatalln("limiter-ip-burst must be at least 1")
+	}
+	// Rate limit policies come from the config file if there is one, then from the
+	// -limiter-policy flags, falling back to the built-in policies.
+	cfg.limiter.policies = defaultRateLimitPolicies
+	if len(limiterPolicies) > 0 {
+		cfg.limiter.policies = limiterPolicies
+	}
+	if cfg.limiter.configFile != "" {
+		def, policies, err := loadRateLimitConfig(cfg.limiter.configFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if def != nil {
+			cfg.limiter.rps, cfg.limiter.burst = def.RPS, def.Burst
+		}
+		cfg.limiter.policies = policies
+	}
+	policy := &data.PasswordPolicy{
+		MinLength:  cfg.passwordPolicy.minLength,
+		MinClasses: cfg.passwordPolicy.minClasses,
+		MinScore:   cfg.passwordPolicy.minScore,
+	}
+	if cfg.passwordPolicy.breachedFile != "" {
+		breached, err := data.LoadBreachedPasswords(cfg.passwordPolicy.breachedFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		policy.Breached = breached
+		logger.PrintInfo("loaded breached password list", map[string]string{"prefixes": fmt.Sprint(breached.Len())})
+	}
+	data.SetPasswordPolicy(policy)
+	// In JWT mode, parse the signing keys. As with the cursor secret, a random key is
+	// generated if none were given, which means that tokens won't survive a restart.
+	var keys *jwt.KeySet
+	switch cfg.auth.mode {
+	case authModeToken:
+	case authModeJWT:
+		var err error
+		if jwtKeys == "" {
+			keys, err = jwt.NewRandomKeys(cfg.auth.jwtAlg)
+			logger.PrintInfo("using a random JWT signing key", nil)
+		} else {
+			keys, err = jwt.ParseKeys(cfg.auth.jwtAlg, jwtKeys)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+	default:
+		log.Fatalf("invalid auth mode %q", cfg.auth.mode)
+	}
 	if cfg.smtp.username == "" && cfg.smtp.password == "" {
 		log.Fatalln("smtp credentials required")
 	}
@@ -150,6 +419,24 @@ func main() {
 		models: data.NewModels(db),
 		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
 	}
+	app.prom = newPromMetrics(db, app.models.EmailJobs, logger)
+	// Check that the default role exists, as otherwise new users would be registered
+	// without any permissions.
+	if err := checkDefaultRole(app.models.Roles, cfg.auth.defaultRole); err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	switch cfg.limiter.store {
+	case "memory":
+		app.limiter = newMemoryRateLimitStore()
+	case "postgres":
+		app.limiter = newPostgresRateLimitStore(app.models.RateLimits, logger)
+	default:
+		log.Fatalf("invalid rate limiter store %q", cfg.limiter.store)
+	}
+	if keys != nil {
+		app.jwtKeys = keys
+		app.jwtRevoked = jwt.NewRevocationList()
+	}
 
 	err = app.serve()
 	if err != nil {
@@ -158,6 +445,21 @@ func main() {
 
 }
 
+// The checkDefaultRole() function returns an error if there is no role with the given
+// code.
+func checkDefaultRole(roles data.RoleModel, code string) error {
+	all, err := roles.GetAll()
+	if err != nil {
+		return err
+	}
+	for _, role := range all {
+		if role.Code == code {
+			return nil
+		}
+	}
+	return fmt.Errorf("default role %q does not exist", code)
+}
+
 // The openDB() function returns a sql.DB connection pool.
 func openDB(cfg config) (*sql.DB, error) {
 	// Use sql.Open() to create an empty connection pool, using the DSN from the config // struct.
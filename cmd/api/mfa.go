@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/data"
+	"github.com/shakilbd009/go-greenlight-api/internal/totp"
+	"github.com/shakilbd009/go-greenlight-api/internal/validator"
+)
+
+// mfaIssuer is the name which authenticator apps show next to the user's account.
+const mfaIssuer = "Greenlight"
+
+// The beginMFAHandler starts two-factor authentication enrollment for the current user.
+// It generates a new TOTP secret and returns it, along with an otpauth:// URI which can
+// be shown as a QR code. MFA isn't enabled until a code is confirmed with the
+// confirmMFAHandler.
+func (app *application) beginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.currentUserErrorResponse(w, r, err)
+		return
+	}
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if !app.checkCurrentPassword(w, r, v, user, input.CurrentPassword) {
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.MFA.Begin(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrMFAEnabled):
+			v.AddError("mfa", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	env := envelope{
+		"secret":      totp.EncodeSecret(secret),
+		"otpauth_uri": totp.URI(mfaIssuer, user.Email, secret),
+	}
+	if err := app.writeJSON(w, http.StatusCreated, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The confirmMFAHandler enables two-factor authentication once the user has proved
+// that their authenticator app is set up, by sending a valid code. The response holds
+// the user's recovery codes, which are never shown again.
+func (app *application) confirmMFAHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	mfa, err := app.models.MFA.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("mfa", "two-factor authentication enrollment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if mfa.Confirmed {
+		v.AddError("mfa", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	step, ok := totp.Validate(mfa.Secret, input.Code, time.Now(), 1)
+	if !ok {
+		v.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	codes, err := app.models.MFA.Confirm(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			// Another request confirmed enrollment or used this code first.
+			v.AddError("code", "is incorrect")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if err := app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The disableMFAHandler turns off two-factor authentication. It needs both the current
+// password and a second factor, so a stolen session alone isn't enough.
+func (app *application) disableMFAHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.currentUserErrorResponse(w, r, err)
+		return
+	}
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		Code            string `json:"code"`
+		RecoveryCode    string `json:"recovery_code"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if !app.checkCurrentPassword(w, r, v, user, input.CurrentPassword) {
+		return
+	}
+	mfa, ok := app.readConfirmedMFA(w, r, v, user.ID)
+	if !ok {
+		return
+	}
+	if !app.checkSecondFactor(w, r, v, mfa, input.Code, input.RecoveryCode) {
+		return
+	}
+	if err := app.models.MFA.Disable(user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env := envelope{"message": "two-factor authentication successfully disabled"}
+	if err := app.writeJSON(w, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The regenerateRecoveryCodesHandler replaces the current user's recovery codes, for
+// example after they have used most of them.
+func (app *application) regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	mfa, ok := app.readConfirmedMFA(w, r, v, user.ID)
+	if !ok {
+		return
+	}
+	v.Check(input.Code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if !app.checkSecondFactor(w, r, v, mfa, input.Code, "") {
+		return
+	}
+	codes, err := app.models.MFA.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createMFAAuthenticationTokenHandler completes a login for a user with two-factor
+// authentication enabled, exchanging the mfa-pending token from
+// createAuthenticationTokenHandler and a TOTP or recovery code for a full
+// authentication token. Wrong codes count towards the account lockout.
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.MFAToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMFAPending, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("mfa_token", "invalid or expired mfa token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Check that MFA is still enabled before claiming a login attempt, as the attempt
+	// wouldn't be given back if it isn't.
+	mfa, ok := app.readConfirmedMFA(w, r, v, user.ID)
+	if !ok {
+		return
+	}
+	if !app.loginAllowed(w, r, user.Email) {
+		return
+	}
+	if !app.checkSecondFactor(w, r, v, mfa, input.Code, input.RecoveryCode) {
+		// checkSecondFactor() has already sent the response, so failing to record the
+		// failure can only be logged.
+		if err := app.recordLoginFailure(r, user.Email, user); err != nil {
+			app.logError(r, err)
+		}
+		return
+	}
+
+	if err := app.models.Tokens.DeleteForPlaintext(data.ScopeMFAPending, input.MFAToken); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := app.loginSucceeded(r, user.Email); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.issueSession(w, r, user, "")
+}
+
+// The readConfirmedMFA() helper fetches a user's MFA record, sending a failed
+// validation response and returning false if MFA isn't enabled.
+func (app *application) readConfirmedMFA(w http.ResponseWriter, r *http.Request, v *validator.Validator, userID int64) (*data.MFA, bool) {
+	mfa, err := app.models.MFA.Get(userID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+	if mfa == nil || !mfa.Confirmed {
+		v.AddError("mfa", "two-factor authentication is not enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+	return mfa, true
+}
+
+// The checkSecondFactor() helper checks either a TOTP code or a recovery code (exactly
+// one must be given), and marks it as used. If it isn't valid, it sends a response and
+// returns false.
+func (app *application) checkSecondFactor(w http.ResponseWriter, r *http.Request, v *validator.Validator, mfa *data.MFA, code, recoveryCode string) bool {
+	v.Check(code != "" || recoveryCode != "", "code", "must be provided")
+	v.Check(code == "" || recoveryCode == "", "recovery_code", "must not be provided together with code")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	var ok bool
+	var err error
+	if code != "" {
+		step, valid := totp.Validate(mfa.Secret, code, time.Now(), 1)
+		if valid {
+			// Each code can only be used once, even though it stays valid for the rest
+			// of its time step.
+			ok, err = app.models.MFA.UseStep(mfa.UserID, step)
+		}
+	} else {
+		ok, err = app.models.MFA.UseRecoveryCode(mfa.UserID, recoveryCode)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !ok {
+		app.invalidCredentialsResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// The checkCurrentPassword() helper checks the password which a user has entered to
+// confirm a sensitive change to their account, sending a failed validation response
+// and returning false if it's missing or wrong.
+func (app *application) checkCurrentPassword(w http.ResponseWriter, r *http.Request, v *validator.Validator, user *data.User, password string) bool {
+	v.Check(password != "", "current_password", "must be provided")
+	if password != "" {
+		match, err := user.Password.Matches(password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+		v.Check(match, "current_password", "is incorrect")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+	return true
+}
@@ -4,18 +4,14 @@ import (
 	"errors"
 	"expvar"
 	"fmt"
-	"net"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/felixge/httpsnoop"
 	"github.com/shakilbd009/go-greenlight-api/internal/data"
 	"github.com/shakilbd009/go-greenlight-api/internal/validator"
-
-	"golang.org/x/time/rate"
 )
 
 // func (app *application) rateLimit(next http.Handler) http.Handler {
@@ -36,6 +32,8 @@ import (
 // 	})
 // }
 
+// The metrics() middleware records request counts and timings in expvar and in the
+// Prometheus metrics, and writes an access log entry for each request.
 func (app *application) metrics(next http.Handler) http.Handler {
 	// Initialize the new expvar variables when the middleware chain is first built.
 	totalRequestsReceived := expvar.NewInt("total_requests_received")
@@ -57,34 +55,78 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		// Note that the expvar map is string-keyed, so we need to use the strconv.Itoa()
 		// function to convert the status code (which is an integer) to a string.
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
+
+		// Record the request in the Prometheus metrics, labelled by route template.
+		info := app.contextGetRequestInfo(r)
+		route := unmatchedRoute
+		if info != nil && info.route != "" {
+			route = info.route
+		}
+		status := strconv.Itoa(metrics.Code)
+		app.prom.requests.Inc(metricsMethod(r), route, status)
+		app.prom.requestDuration.Observe(metrics.Duration.Seconds(), metricsMethod(r), route, status)
+
+		// Write the access log entry for the request.
+		properties := map[string]string{
+			"request_method": r.Method,
+			"request_url":    r.URL.String(),
+			"status":         status,
+			"bytes":          strconv.FormatInt(metrics.Written, 10),
+			"duration_ms":    strconv.FormatFloat(float64(metrics.Duration)/float64(time.Millisecond), 'f', 3, 64),
+			"remote_ip":      app.clientIP(r),
+		}
+		if info != nil {
+			properties["request_id"] = info.id
+			if info.userID != 0 {
+				properties["user_id"] = strconv.FormatInt(info.userID, 10)
+			}
+		}
+		app.logger.PrintInfo("request completed", properties)
 	})
 }
 
+// The enableCORS() middleware applies the CORS policy for the route (see corsPolicy) to
+// cross-origin requests, answering preflight requests itself.
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on these request headers, so caches must take them
+		// into account.
 		w.Header().Add("Vary", "Origin")
-
-		// Add the "Vary: Access-Control-Request-Method" header.
 		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+
 		origin := r.Header.Get("Origin")
-		if origin != "" && len(app.config.cors.trustedOrigins) != 0 {
-			// Loop through the list of trusted origins, checking to see if the request
-			// origin exactly matches one of them.
-			for _, v := range app.config.cors.trustedOrigins {
-				if origin == v {
-					// If there is a match, then set a "Access-Control-Allow-Origin"
-					// response header with the request origin as the value.
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-						// Write the headers along with a 200 OK status and return from // the middleware with no further action.
-						w.WriteHeader(http.StatusOK)
-						return
-					}
-				}
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		policy := app.corsPolicyFor(r)
+		if !policy.allowsOrigin(origin) {
+			// Log the rejected origin, unless CORS isn't enabled for this route at
+			// all, to help track down misconfigured front ends. The request still goes
+			// ahead without any CORS headers, so the browser won't let the page read
+			// the response.
+			if len(policy.Origins) > 0 {
+				app.logger.PrintInfo("rejected CORS origin", map[string]string{
+					"origin":    origin,
+					"policy":    policy.Name,
+					"method":    r.Method,
+					"url":       r.URL.String(),
+					"remote_ip": app.clientIP(r),
+				})
 			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		// A preflight request is an OPTIONS request with the
+		// Access-Control-Request-Method header. Write the headers along with a 200 OK
+		// status and return from the middleware with no further action.
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			setCORSHeaders(w, policy, origin, true)
+			w.WriteHeader(http.StatusOK)
+			return
 		}
+		setCORSHeaders(w, policy, origin, false)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -93,23 +135,70 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		// Retrieve the user from the request context.
 		user := app.contextGetUser(r)
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+		// JWTs carry the user's permissions, so there's no need to look them up.
+		var permissions data.Permissions
+		if claims := app.contextGetClaims(r); claims != nil {
+			permissions = claims.Permissions
+		} else {
+			var err error
+			permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 		}
 		// Check if the slice includes the required permission. If it doesn't, then
 		// return a 403 Forbidden response.
+		// Requests made with an API key or OAuth access token are also limited to the
+		// permissions granted to it.
 		if !permissions.Include(code) {
 			app.notPermittedResponse(w, r)
 			return
 		}
+		if limit := app.contextGetPermissionLimit(r); limit != nil && !limit.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		// Some permissions can only be used once the user has enabled two-factor
+		// authentication.
+		if validator.In(code, app.config.auth.mfaRequired...) {
+			var mfaEnabled bool
+			if claims := app.contextGetClaims(r); claims != nil {
+				mfaEnabled = claims.MFA
+			} else {
+				var err error
+				mfaEnabled, err = app.models.MFA.Enabled(user.ID)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+			}
+			if !mfaEnabled {
+				app.mfaRequiredResponse(w, r)
+				return
+			}
+		}
 		// Otherwise they have the required permission so we call the next handler in // the chain.
 		next.ServeHTTP(w, r)
 	}
 	return app.requireActivatedUser(fn)
 }
 
+// The requireUserSession() middleware rejects requests made with an API key or an OAuth
+// access token. It guards the endpoints which manage the user's account and
+// credentials, so that a leaked key, or a third-party client, can't be used to take
+// over the account or mint new credentials.
+func (app *application) requireUserSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetPermissionLimit(r) != nil {
+			app.delegatedCredentialResponse(w, r)
+			return
+		}
+		next(w, r)
+	}
+	return app.requireAuthenticatedUser(fn)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -150,21 +239,69 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// If there is no Authorization header found, use the contextSetUser() helper
 		// that we just made to add the AnonymousUser to the request context. Then we
 		// call the next handler in the chain and return without executing any of the // code below.
-		if authHeader == "" {
+		// The Basic scheme is only used by OAuth clients to authenticate to the token
+		// endpoint, which checks the credentials itself, so the request is anonymous as
+		// far as users are concerned.
+		if authHeader == "" || strings.HasPrefix(authHeader, "Basic ") {
 			r = app.contextSetUser(r, data.Anonymous)
 			next.ServeHTTP(w, r)
 			return
 		}
 		// Otherwise, we expect the value of the Authorization header to be in the format
-		// "Bearer <token>". We try to split this into its constituent parts, and if the
-		// header isn't in the expected format we return a 401 Unauthorized response
-		// using the invalidAuthenticationTokenResponse() helper (which we will create // in a moment).
+		// "Bearer <token>" or "ApiKey <key>". We try to split this into its constituent
+		// parts, and if the header isn't in the expected format we return a 401
+		// Unauthorized response using the invalidAuthenticationTokenResponse() helper
+		// (which we will create // in a moment).
 		headerParts := strings.Split(authHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		if len(headerParts) != 2 || (headerParts[0] != "Bearer" && headerParts[0] != "ApiKey") {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 		token := headerParts[1]
+
+		if headerParts[0] == "ApiKey" {
+			v := validator.New()
+			if data.ValidateAPIKeyPlaintext(v, token); !v.Valid() {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			user, key, err := app.models.APIKeys.GetForPlaintext(token)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+			if err := app.models.APIKeys.Touch(key.ID); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			r = app.contextSetUser(r, user)
+			r = app.contextSetAPIKey(r, key)
+			r = app.contextSetPermissionLimit(r, key.Permissions)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// In JWT mode the token is verified in-process, without a database lookup.
+		// OAuth access tokens are always opaque tokens stored in the database, so only
+		// tokens which look like a JWT are handled here.
+		if app.config.auth.mode == authModeJWT && strings.Count(token, ".") == 2 {
+			user, claims, err := app.verifyAccessToken(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			r = app.contextSetUser(r, user)
+			r = app.contextSetToken(r, token)
+			r = app.contextSetClaims(r, claims)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		v := validator.New()
 
 		// If the token isn't valid, use the invalidAuthenticationTokenResponse()
@@ -175,9 +312,9 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 		// Retrieve the details of the user associated with the authentication token,
 		// again calling the invalidAuthenticationTokenResponse() helper if no
-		// matching record was found. IMPORTANT: Notice that we are using
-		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		// matching record was found. Tokens issued to OAuth clients come with the
+		// permissions which the user granted to the client.
+		user, limit, err := app.models.Users.GetForAuthenticationToken(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -187,62 +324,79 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			}
 			return
 		}
+		// Record when the session was last used, so that the user can see which of their
+		// sessions are still active.
+		if err := app.models.Tokens.Touch(token); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
+		if limit != nil {
+			r = app.contextSetPermissionLimit(r, limit)
+		}
 
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			mu.Lock()
-			for ip, client := range clients {
-
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
+// The ipRateLimit() middleware applies a coarse limit to each client IP address. It
+// runs before authenticate(), so that requests with invalid credentials (each of which
+// costs a database lookup) are limited as well; rateLimit() can't see those, as
+// authenticate() rejects them before it runs.
+func (app *application) ipRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.config.limiter.enabled && app.config.limiter.ipRPS > 0 {
+			policy := &rateLimitPolicy{Name: "ip", RPS: app.config.limiter.ipRPS, Burst: app.config.limiter.ipBurst}
+			if !app.applyRateLimit(w, r, policy, "ip:"+app.clientIP(r)) {
+				return
 			}
-			mu.Unlock()
 		}
-	}()
+		next.ServeHTTP(w, r)
+	})
+}
 
+// The rateLimit() middleware applies the rate limit policy for the route to each
+// client. Authenticated requests are limited per user, so that users behind a shared
+// IP address don't use up each other's allowance; anonymous requests are limited per
+// IP address. It must run after authenticate().
+func (app *application) rateLimit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if app.config.limiter.enabled {
-			// ip := realip.FromRequest(r)
-
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				app.serverErrorResponse(w, r, err)
-				return
+			policy := app.rateLimitPolicyFor(r)
+			key := policy.Name + ":ip:" + app.clientIP(r)
+			if user := app.contextGetUser(r); !user.IsAnonymous() {
+				key = policy.Name + ":user:" + strconv.FormatInt(user.ID, 10)
 			}
-			mu.Lock()
-			if _, ok := clients[ip]; !ok {
-				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
-			}
-			clients[ip].lastSeen = time.Now()
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
+			if !app.applyRateLimit(w, r, policy, key) {
 				return
 			}
-			mu.Unlock()
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The applyRateLimit() helper takes one request from the client's allowance under the
+// policy and sets the RateLimit headers. If the request is over the limit, it sends a
+// 429 response and returns false.
+func (app *application) applyRateLimit(w http.ResponseWriter, r *http.Request, policy *rateLimitPolicy, key string) bool {
+	result, err := app.limiter.Take(key, policy, time.Now())
+	if err != nil {
+		// Rather than failing every request while the shared store is unavailable,
+		// log the error and let the request through.
+		app.logError(r, err)
+		return true
+	}
+	setRateLimitHeaders(w, policy, result)
+	if !result.Allowed {
+		app.prom.rateLimitRejection.Inc(policy.Name)
+		app.rateLimitExceededResponse(w, r)
+		return false
+	}
+	return true
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -81,6 +81,16 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+	// If the client asked for the credits to be embedded (with "?embed=credits"), look
+	// them up and include them in the movie.
+	embed := app.readCSV(r.URL.Query(), "embed", []string{})
+	if validator.In("credits", embed...) {
+		movie.Credits, err = app.models.Credits.GetAllForMovie(movie.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
 	if err := app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -187,6 +197,7 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	var input struct {
 		Title  string
 		Genres []string
+		People data.CreditFilters
 		data.Filters
 	}
 	// Initialize a new Validator instance.
@@ -197,15 +208,26 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	// to defaults of an empty string and an empty slice respectively if they are not // provided by the client.
 	input.Title = app.readString(qs, "title", "")
 	input.Genres = app.readCSV(qs, "genres", []string{})
+	// The director, actor and writer values filter on the names of people credited on
+	// the movie in that role.
+	input.People.Director = app.readString(qs, "director", "")
+	input.People.Actor = app.readString(qs, "actor", "")
+	input.People.Writer = app.readString(qs, "writer", "")
 	// Get the page and page_size query string values as integers. Notice that we set
 	// the default page value to 1 and default page_size to 20, and that we pass the // validator instance as the final argument here.
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Read the opaque keyset pagination cursor, if there is one. Clients can follow the
+	// next_cursor and prev_cursor values in the response metadata instead of using page
+	// numbers, which is faster for deep pages and stable when movies are added.
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.CursorKey = app.config.cursor.secret
 	// Extract the sort query string value, falling back to "id" if it is not provided
 	// by the client (which will imply a ascending sort on movie ID).
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	// Add the supported sort values for this endpoint to the sort safelist.
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "average_rating", "review_count",
+		"-id", "-title", "-year", "-runtime", "-average_rating", "-review_count"}
 
 	// Execute the validation checks on the Filters struct and send a response // containing the errors if necessary.
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
@@ -214,7 +236,7 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 	}
 
 	// Call the GetAll() method to retrieve the movies, passing in the various filter // parameters.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.People, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/data"
+	"github.com/shakilbd009/go-greenlight-api/internal/validator"
+)
+
+// OAuth scopes are the permission codes which the access token can use, so a client
+// asking for "movies:read watchlist:manage" gets a token limited to those permissions.
+// PKCE code verifiers and S256 challenges must match these patterns (RFC 7636 section
+// 4.1 and 4.2).
+var (
+	pkceVerifierRX  = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+	pkceChallengeRX = regexp.MustCompile(`^[A-Za-z0-9\-_]{43}$`)
+)
+
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	clients, err := app.models.OAuthClients.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := app.writeJSON(w, http.StatusOK, envelope{"clients": clients}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createOAuthClientHandler registers an OAuth client owned by the current user. For
+// confidential clients the response includes the client secret, which is never shown
+// again.
+func (app *application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	client := &data.OAuthClient{
+		UserID:       app.contextGetUser(r).ID,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		Confidential: input.Confidential,
+	}
+
+	knownPermissions, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateOAuthClient(v, client, knownPermissions); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if err := app.models.OAuthClients.Insert(client); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := app.writeJSON(w, http.StatusCreated, envelope{"client": client}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteOAuthClientHandler deletes one of the current user's clients, which also
+// revokes every access token issued to it.
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.OAuthClients.Delete(app.contextGetUser(r).ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "OAuth client successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authorizeRequest holds the parameters of an authorization request (RFC 6749 section
+// 4.1.1), once they have been checked by readAuthorizeRequest().
+type authorizeRequest struct {
+	client      *data.OAuthClient
+	redirectURI string
+	// redirectURIExplicit records whether the client sent the redirect_uri, rather than
+	// relying on its only registered one.
+	redirectURIExplicit bool
+	state               string
+	scopes              data.Permissions
+	codeChallenge       string
+}
+
+// The readAuthorizeRequest() helper checks the parameters of an authorization request
+// against the client's registration, and works out which of the requested scopes can be
+// granted: those which the client may request and the user actually has. If the request
+// isn't valid, it sends a failed validation response and returns false.
+func (app *application) readAuthorizeRequest(w http.ResponseWriter, r *http.Request, params url.Values) (*authorizeRequest, bool) {
+	v := validator.New()
+	clientID := params.Get("client_id")
+	v.Check(clientID != "", "client_id", "must be provided")
+	v.Check(params.Get("response_type") == "code", "response_type", "must be code")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	client, err := app.models.OAuthClients.GetByClientID(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "unknown client")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	req := &authorizeRequest{
+		client:              client,
+		redirectURI:         params.Get("redirect_uri"),
+		redirectURIExplicit: params.Get("redirect_uri") != "",
+		state:               params.Get("state"),
+		codeChallenge:       params.Get("code_challenge"),
+	}
+	// A client with a single redirect URI may leave it out.
+	if req.redirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.redirectURI = client.RedirectURIs[0]
+	}
+	v.Check(client.AllowsRedirectURI(req.redirectURI), "redirect_uri", "must match one of the client's redirect URIs")
+
+	// Only the S256 method is supported, as plain challenges don't protect the code if
+	// the authorization request is intercepted. Public clients can't keep a secret, so
+	// they must use PKCE.
+	if req.codeChallenge != "" || params.Get("code_challenge_method") != "" {
+		v.Check(params.Get("code_challenge_method") == "S256", "code_challenge_method", "must be S256")
+		v.Check(validator.Matches(req.codeChallenge, pkceChallengeRX), "code_challenge", "must be a base64url encoded SHA-256 hash")
+	}
+	v.Check(client.Confidential || req.codeChallenge != "", "code_challenge", "must be provided for public clients")
+
+	requested := data.Permissions(strings.Fields(params.Get("scope")))
+	if len(requested) == 0 {
+		requested = client.Scopes
+	}
+	for _, code := range requested {
+		v.Check(client.Scopes.Include(code), "scope", "must only contain scopes which the client is registered for")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	req.scopes, err = app.grantableScopes(app.contextGetUser(r).ID, requested)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+	if len(req.scopes) == 0 {
+		v.AddError("scope", "you don't have any of the requested permissions")
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+	return req, true
+}
+
+// The grantableScopes() helper returns the scopes, in the requested order, which the
+// user has the permission for.
+func (app *application) grantableScopes(userID int64, requested data.Permissions) (data.Permissions, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	scopes := data.Permissions{}
+	for _, code := range requested {
+		if permissions.Include(code) && !scopes.Include(code) {
+			scopes = append(scopes, code)
+		}
+	}
+	return scopes, nil
+}
+
+// The showAuthorizationHandler checks an authorization request and returns the details
+// which the frontend needs to ask the user for their consent: the client's name and the
+// scopes which would be granted. The request parameters are passed in the query string.
+func (app *application) showAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := app.readAuthorizeRequest(w, r, r.URL.Query())
+	if !ok {
+		return
+	}
+	env := envelope{
+		"client":       envelope{"client_id": req.client.ClientID, "name": req.client.Name},
+		"redirect_uri": req.redirectURI,
+		"scopes":       req.scopes,
+	}
+	if err := app.writeJSON(w, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createAuthorizationHandler records the user's decision on an authorization
+// request. The request parameters are sent again in the JSON body, along with an
+// approve field. The response holds the URI to redirect the user back to the client
+// with: carrying an authorization code if the request was approved, or an access_denied
+// error if it wasn't.
+func (app *application) createAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ClientID            string `json:"client_id"`
+		ResponseType        string `json:"response_type"`
+		RedirectURI         string `json:"redirect_uri"`
+		Scope               string `json:"scope"`
+		State               string `json:"state"`
+		CodeChallenge       string `json:"code_challenge"`
+		CodeChallengeMethod string `json:"code_challenge_method"`
+		Approve             *bool  `json:"approve"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if v.Check(input.Approve != nil, "approve", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	params := url.Values{
+		"client_id":             {input.ClientID},
+		"response_type":         {input.ResponseType},
+		"redirect_uri":          {input.RedirectURI},
+		"scope":                 {input.Scope},
+		"state":                 {input.State},
+		"code_challenge":        {input.CodeChallenge},
+		"code_challenge_method": {input.CodeChallengeMethod},
+	}
+	req, ok := app.readAuthorizeRequest(w, r, params)
+	if !ok {
+		return
+	}
+
+	result := url.Values{}
+	if *input.Approve {
+		code := &data.OAuthCode{
+			ClientID:            req.client.ID,
+			UserID:              app.contextGetUser(r).ID,
+			RedirectURI:         req.redirectURI,
+			RedirectURIExplicit: req.redirectURIExplicit,
+			Scopes:              req.scopes,
+			CodeChallenge:       req.codeChallenge,
+		}
+		if err := app.models.OAuthCodes.New(code, app.config.oauth.codeTTL); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		result.Set("code", code.Plaintext)
+	} else {
+		result.Set("error", "access_denied")
+	}
+	if req.state != "" {
+		result.Set("state", req.state)
+	}
+
+	redirect, err := url.Parse(req.redirectURI)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	query := redirect.Query()
+	for key, values := range result {
+		query[key] = values
+	}
+	redirect.RawQuery = query.Encode()
+	if err := app.writeJSON(w, http.StatusOK, envelope{"redirect_uri": redirect.String()}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createOAuthTokenHandler is the OAuth2 token endpoint (RFC 6749 section 3.2). It
+// takes form-encoded parameters and supports the authorization_code grant (with PKCE)
+// and the client_credentials grant. Clients authenticate with HTTP Basic auth or the
+// client_id and client_secret parameters; public clients only send their client_id.
+func (app *application) createOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+	if err := r.ParseForm(); err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the request body must be form-encoded")
+		return
+	}
+	client, ok := app.authenticateOAuthClient(w, r)
+	if !ok {
+		return
+	}
+
+	var userID int64
+	var requested data.Permissions
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, err := app.models.OAuthCodes.Consume(r.PostForm.Get("code"), client.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid, expired or already used authorization code")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		// If the authorization request included a redirect_uri, the same one must be
+		// sent again here (RFC 6749 section 4.1.3).
+		redirectURI := r.PostForm.Get("redirect_uri")
+		if (code.RedirectURIExplicit || redirectURI != "") && redirectURI != code.RedirectURI {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request")
+			return
+		}
+		if !verifyPKCE(code.CodeChallenge, r.PostForm.Get("code_verifier")) {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid code_verifier")
+			return
+		}
+		userID, requested = code.UserID, code.Scopes
+	case "client_credentials":
+		// Only confidential clients can use this grant, in which the client acts on
+		// behalf of the user who registered it.
+		if !client.Confidential {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client_credentials grant")
+			return
+		}
+		userID, requested = client.UserID, data.Permissions(strings.Fields(r.PostForm.Get("scope")))
+		if len(requested) == 0 {
+			requested = client.Scopes
+		}
+		for _, code := range requested {
+			if !client.Scopes.Include(code) {
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the client isn't registered for scope "+code)
+				return
+			}
+		}
+	default:
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or client_credentials")
+		return
+	}
+
+	// Check the user again, as their account or permissions may have changed since the
+	// code was issued.
+	user, err := app.models.Users.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the user no longer exists")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !user.Activated {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "the user account is not activated")
+		return
+	}
+	scopes, err := app.grantableScopes(user.ID, requested)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if len(scopes) == 0 {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the user doesn't have any of the requested permissions")
+		return
+	}
+
+	token, err := app.models.Tokens.NewOAuth(user.ID, client.ID, app.config.oauth.tokenTTL, scopes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	env := envelope{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(app.config.oauth.tokenTTL.Seconds()),
+		"scope":        strings.Join(scopes, " "),
+	}
+	if err := app.writeJSON(w, http.StatusOK, env, headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The authenticateOAuthClient() helper identifies the client making a token request.
+// Confidential clients must give their secret; public clients can't have one, so they
+// are identified by their client_id alone and rely on PKCE instead. If the client can't
+// be authenticated, an invalid_client error is sent and false is returned.
+func (app *application) authenticateOAuthClient(w http.ResponseWriter, r *http.Request) (*data.OAuthClient, bool) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// The credentials are form-encoded before being put in the header (RFC 6749
+		// section 2.3.1).
+		var err1, err2 error
+		clientID, err1 = url.QueryUnescape(clientID)
+		secret, err2 = url.QueryUnescape(secret)
+		if err1 != nil || err2 != nil {
+			app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "malformed client credentials")
+			return nil, false
+		}
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID == "" {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication is required")
+		return nil, false
+	}
+
+	client, err := app.models.OAuthClients.GetByClientID(clientID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+	if client == nil || (client.Confidential && !client.SecretMatches(secret)) || (!client.Confidential && secret != "") {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, false
+	}
+	return client, true
+}
+
+// verifyPKCE checks a code verifier against the S256 challenge from the authorization
+// request (RFC 7636 section 4.6). If no challenge was given, no verifier may be sent.
+func verifyPKCE(challenge, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+	if !validator.Matches(verifier, pkceVerifierRX) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"runtime"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/shakilbd009/go-greenlight-api/internal/data"
+	"github.com/shakilbd009/go-greenlight-api/internal/jsonlog"
+	"github.com/shakilbd009/go-greenlight-api/internal/metrics"
+)
+
+// promMetrics holds the metrics which are served at /metrics in the Prometheus text
+// format. Request metrics are labelled with the route template (such as
+// /v1/movies/:id) rather than the URL, so that each endpoint is a single series.
+type promMetrics struct {
+	registry           *metrics.Registry
+	requests           *metrics.CounterVec
+	requestDuration    *metrics.HistogramVec
+	rateLimitRejection *metrics.CounterVec
+}
+
+// newPromMetrics registers the application's metrics, including gauges which read the
+// database connection pool statistics and the email queue depth when they are scraped.
+// Errors counting the email queue are logged with logger.
+func newPromMetrics(db *sql.DB, emailJobs data.EmailJobModel, logger *jsonlog.Logger) *promMetrics {
+	reg := metrics.NewRegistry()
+	m := &promMetrics{
+		registry: reg,
+		requests: reg.NewCounterVec("greenlight_http_requests_total",
+			"Number of HTTP requests handled.", "method", "route", "status"),
+		requestDuration: reg.NewHistogramVec("greenlight_http_request_duration_seconds",
+			"Time taken to handle HTTP requests.", metrics.DefaultBuckets, "method", "route", "status"),
+		rateLimitRejection: reg.NewCounterVec("greenlight_rate_limit_rejections_total",
+			"Number of requests rejected by the rate limiter.", "policy"),
+	}
+
+	reg.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+
+	reg.NewGaugeFunc("greenlight_db_max_open_connections", "Maximum number of open database connections.", func() float64 {
+		return float64(db.Stats().MaxOpenConnections)
+	})
+	reg.NewGaugeFunc("greenlight_db_open_connections", "Number of established database connections.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	reg.NewGaugeFunc("greenlight_db_in_use_connections", "Number of database connections currently in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	reg.NewGaugeFunc("greenlight_db_idle_connections", "Number of idle database connections.", func() float64 {
+		return float64(db.Stats().Idle)
+	})
+	reg.NewCounterFunc("greenlight_db_wait_count_total", "Number of times a database connection had to be waited for.", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	reg.NewCounterFunc("greenlight_db_wait_duration_seconds_total", "Total time spent waiting for database connections.", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+	reg.NewCounterFunc("greenlight_db_max_idle_closed_total", "Number of database connections closed because of the idle connection limit.", func() float64 {
+		return float64(db.Stats().MaxIdleClosed)
+	})
+	reg.NewCounterFunc("greenlight_db_max_lifetime_closed_total", "Number of database connections closed because they reached their maximum lifetime.", func() float64 {
+		return float64(db.Stats().MaxLifetimeClosed)
+	})
+
+	// If the queue can't be counted, report NaN rather than a misleading zero.
+	reg.NewGaugeFunc("greenlight_mail_queue_depth", "Number of emails waiting to be delivered.", func() float64 {
+		n, err := emailJobs.CountPending()
+		if err != nil {
+			logger.PrintError(err, nil)
+			return math.NaN()
+		}
+		return float64(n)
+	})
+
+	return m
+}
+
+// unmatchedRoute is the route label used for requests which don't reach a route's
+// handler, such as 404s, 405s, CORS preflight requests and requests rejected by the
+// rate limiter.
+const unmatchedRoute = "unmatched"
+
+// metricsMethod returns the method label for a request. Non-standard methods are
+// grouped together, so that clients can't create an unlimited number of series.
+func metricsMethod(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return r.Method
+	default:
+		return "other"
+	}
+}
+
+// instrumentedRouter wraps httprouter.Router so that each handler records the route
+// template it was registered with in the requestInfo, for use as a metric label.
+// httprouter itself doesn't make the matched template available.
+type instrumentedRouter struct {
+	*httprouter.Router
+	app *application
+}
+
+func (rt instrumentedRouter) Handler(method, path string, handler http.Handler) {
+	rt.Router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := rt.app.contextGetRequestInfo(r); info != nil {
+			info.route = path
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func (rt instrumentedRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	rt.Handler(method, path, handler)
+}
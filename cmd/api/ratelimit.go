@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/data"
+	"github.com/shakilbd009/go-greenlight-api/internal/jsonlog"
+)
+
+// rateLimitPolicy sets the request rate allowed for a group of routes: a sustained rate
+// of RPS requests per second, with bursts of up to Burst requests. The policy applies to
+// requests whose path starts with Prefix and whose method is one of Methods (or any
+// method, if Methods is empty). Each user (or, for anonymous requests, each client IP
+// address) has a separate allowance for each policy.
+type rateLimitPolicy struct {
+	Name    string   `json:"name"`
+	Methods []string `json:"methods"`
+	Prefix  string   `json:"prefix"`
+	RPS     float64  `json:"rps"`
+	Burst   int      `json:"burst"`
+}
+
+// defaultRateLimitPolicies are used when no policies are given with the -limiter-policy
+// flag or a config file: token endpoints (logins, password resets and so on) get a
+// tighter limit, and reading movies a looser one.
+var defaultRateLimitPolicies = []rateLimitPolicy{
+	{Name: "tokens", Methods: []string{http.MethodPost, http.MethodPut}, Prefix: "/v1/tokens/", RPS: 0.5, Burst: 4},
+	{Name: "movies-read", Methods: []string{http.MethodGet}, Prefix: "/v1/movies", RPS: 5, Burst: 10},
+}
+
+func (p *rateLimitPolicy) matches(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, p.Prefix) {
+		return false
+	}
+	if len(p.Methods) == 0 {
+		return true
+	}
+	for _, method := range p.Methods {
+		if method == r.Method {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *rateLimitPolicy) validate() error {
+	if p.Name == "" {
+		return errors.New("rate limit policy name must be provided")
+	}
+	if p.RPS <= 0 || p.Burst < 1 {
+		return fmt.Errorf("rate limit policy %q: rps must be positive and burst at least 1", p.Name)
+	}
+	if p.Name != "default" && !strings.HasPrefix(p.Prefix, "/") {
+		return fmt.Errorf("rate limit policy %q: prefix must start with /", p.Name)
+	}
+	return nil
+}
+
+// rateLimitPolicyFlag collects the values of the repeatable -limiter-policy flag, each
+// in the format name:METHOD,METHOD:/prefix:rps:burst, where the methods can be * to
+// match any method. For example:
+//
+//	-limiter-policy tokens:POST:/v1/tokens/:0.5:4
+type rateLimitPolicyFlag []rateLimitPolicy
+
+func (f *rateLimitPolicyFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, len(*f))
+	for i, p := range *f {
+		methods := strings.Join(p.Methods, ",")
+		if methods == "" {
+			methods = "*"
+		}
+		parts[i] = fmt.Sprintf("%s:%s:%s:%g:%d", p.Name, methods, p.Prefix, p.RPS, p.Burst)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (f *rateLimitPolicyFlag) Set(value string) error {
+	fields := strings.Split(value, ":")
+	if len(fields) != 5 {
+		return errors.New("rate limit policies must be in the format name:methods:prefix:rps:burst")
+	}
+	p := rateLimitPolicy{Name: fields[0], Prefix: fields[2]}
+	if fields[1] != "*" {
+		p.Methods = strings.Split(strings.ToUpper(fields[1]), ",")
+	}
+	var err error
+	if p.RPS, err = strconv.ParseFloat(fields[3], 64); err != nil {
+		return fmt.Errorf("invalid rps %q", fields[3])
+	}
+	if p.Burst, err = strconv.Atoi(fields[4]); err != nil {
+		return fmt.Errorf("invalid burst %q", fields[4])
+	}
+	if err := p.validate(); err != nil {
+		return err
+	}
+	*f = append(*f, p)
+	return nil
+}
+
+// loadRateLimitConfig reads rate limit settings from a JSON file. The file can set the
+// default limit, which applies to requests that don't match any of the policies, and
+// the list of policies:
+//
+//	{
+//		"default": {"rps": 2, "burst": 4},
+//		"policies": [
+//			{"name": "tokens", "methods": ["POST"], "prefix": "/v1/tokens/", "rps": 0.5, "burst": 4}
+//		]
+//	}
+//
+// If the default is left out, the -limiter-rps and -limiter-burst flags are used.
+func loadRateLimitConfig(path string) (*rateLimitPolicy, []rateLimitPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	var file struct {
+		Default  *rateLimitPolicy  `json:"default"`
+		Policies []rateLimitPolicy `json:"policies"`
+	}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Default != nil {
+		file.Default.Name = "default"
+		if err := file.Default.validate(); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	for i := range file.Policies {
+		if err := file.Policies[i].validate(); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return file.Default, file.Policies, nil
+}
+
+// The rateLimitPolicyFor() helper returns the first policy which matches the request,
+// or the default policy.
+func (app *application) rateLimitPolicyFor(r *http.Request) *rateLimitPolicy {
+	for i := range app.config.limiter.policies {
+		if app.config.limiter.policies[i].matches(r) {
+			return &app.config.limiter.policies[i]
+		}
+	}
+	return &rateLimitPolicy{Name: "default", RPS: app.config.limiter.rps, Burst: app.config.limiter.burst}
+}
+
+// rateLimitStore keeps track of how much of their allowance each client has used. The
+// key identifies both the client and the policy. Stores which are shared between
+// instances may use their own clock rather than now.
+type rateLimitStore interface {
+	Take(key string, policy *rateLimitPolicy, now time.Time) (rateLimitResult, error)
+}
+
+// memoryRateLimitStore keeps a token bucket for each key in memory. It's fast, but each
+// instance of the API has its own limits, which are lost when it restarts.
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	clients map[string]*memoryRateLimitClient
+}
+
+type memoryRateLimitClient struct {
+	bucket   tokenBucket
+	lastSeen time.Time
+}
+
+// newMemoryRateLimitStore returns a memoryRateLimitStore, and starts a background
+// goroutine which forgets clients that haven't been seen for a few minutes.
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	s := &memoryRateLimitStore{clients: make(map[string]*memoryRateLimitClient)}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			s.mu.Lock()
+			for key, client := range s.clients {
+				if time.Since(client.lastSeen) > 3*time.Minute {
+					delete(s.clients, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}()
+	return s
+}
+
+func (s *memoryRateLimitStore) Take(key string, policy *rateLimitPolicy, now time.Time) (rateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, ok := s.clients[key]
+	if !ok {
+		client = &memoryRateLimitClient{}
+		s.clients[key] = client
+	}
+	client.lastSeen = now
+	return client.bucket.take(policy, now), nil
+}
+
+// postgresRateLimitStore keeps the limits in the database, using the generic cell rate
+// algorithm (see data.RateLimitModel), so that every instance of the API shares them
+// and they survive restarts. It costs a query per request.
+type postgresRateLimitStore struct {
+	model data.RateLimitModel
+}
+
+// newPostgresRateLimitStore returns a postgresRateLimitStore, and starts a background
+// goroutine which deletes keys whose allowance has been refilled. Errors from the
+// cleanup are logged with logger.
+func newPostgresRateLimitStore(model data.RateLimitModel, logger *jsonlog.Logger) *postgresRateLimitStore {
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			if err := model.DeleteExpired(); err != nil {
+				logger.PrintError(err, nil)
+			}
+		}
+	}()
+	return &postgresRateLimitStore{model: model}
+}
+
+func (s *postgresRateLimitStore) Take(key string, policy *rateLimitPolicy, now time.Time) (rateLimitResult, error) {
+	interval := 1 / policy.RPS
+	limit := float64(policy.Burst) * interval
+	allowed, tat, dbNow, err := s.model.Take(key, interval, limit)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	result := rateLimitResult{Allowed: allowed, Reset: secondsToDuration(tat - dbNow)}
+	if allowed {
+		result.Remaining = int((limit - (tat - dbNow)) / interval)
+	} else {
+		result.RetryAfter = secondsToDuration(tat + interval - dbNow - limit)
+	}
+	return result, nil
+}
+
+// tokenBucket holds the state of one client's allowance under a policy. The bucket
+// holds up to Burst tokens and refills at RPS tokens per second; each request takes
+// one token.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitResult describes the outcome of taking a token from a bucket. Remaining is
+// the number of whole tokens left, Reset is how long until the bucket is full again,
+// and RetryAfter is how long until the next token is available (zero if the request
+// was allowed).
+type rateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// take refills the bucket for the time since it was last used and tries to take a
+// token from it. A zero-valued bucket starts full.
+func (b *tokenBucket) take(policy *rateLimitPolicy, now time.Time) rateLimitResult {
+	burst := float64(policy.Burst)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed*policy.RPS)
+	}
+	b.last = now
+
+	var result rateLimitResult
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / policy.RPS)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsToDuration((burst - b.tokens) / policy.RPS)
+	return result
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// The setRateLimitHeaders() helper adds the RateLimit-* headers (from the IETF
+// RateLimit header fields draft) describing the client's allowance, and a Retry-After
+// header if the request was rejected.
+func setRateLimitHeaders(w http.ResponseWriter, policy *rateLimitPolicy, result rateLimitResult) {
+	window := int(math.Ceil(float64(policy.Burst) / policy.RPS))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(policy.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;name=%q", policy.Burst, window, policy.Name))
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+	}
+}
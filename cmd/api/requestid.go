@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// maxRequestIDLength is the longest X-Request-ID header which we accept from clients.
+const maxRequestIDLength = 128
+
+// requestInfo holds the details of a request which are needed for the access log and
+// metrics. It is stored in the request context as a pointer by the requestID()
+// middleware, so that middleware and handlers further down the chain (such as
+// authenticate(), via contextSetUser()) can fill it in.
+type requestInfo struct {
+	id     string
+	userID int64
+	// route is the template of the route which handled the request, such as
+	// /v1/movies/:id, or empty if no route matched.
+	route string
+}
+
+// The requestID() middleware gives every request an ID, which is returned to the client
+// in the X-Request-ID header and in error responses, and included in the access log
+// and error log entries. If the client (or a proxy in front of us) sends a reasonable
+// looking X-Request-ID header, that is used so that requests can be traced across
+// services; otherwise a random ID is generated.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = app.contextSetRequestInfo(r, &requestInfo{id: id})
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID reports whether a client-supplied request ID is short enough and only
+// contains characters which are safe to log and echo back: letters, digits, and
+// '-', '_', '.' and ':'.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128-bit request ID, hex encoded.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -8,8 +8,9 @@ import (
 )
 
 func (app *application) routes() http.Handler {
-	// Initialize a new httprouter router instance.
-	router := httprouter.New()
+	// Initialize a new httprouter router instance, wrapped so that the route templates
+	// are recorded for the Prometheus metrics.
+	router := instrumentedRouter{Router: httprouter.New(), app: app}
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 	// Register the relevant methods, URL patterns and handler functions for our
@@ -26,19 +27,107 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
 
+	// Reviews only need the movies:read permission, as users can only ever create or
+	// change their own reviews.
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews", app.requirePermission("movies:read", app.listReviewsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/reviews", app.requirePermission("movies:read", app.createReviewHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id/reviews/:review_id", app.requirePermission("movies:read", app.updateReviewHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/reviews/:review_id", app.requirePermission("movies:read", app.deleteReviewHandler))
+
+	// People can be read by anyone who can read movies, but changing people or the
+	// credits which link them to movies requires the people:write permission.
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/credits", app.requirePermission("people:write", app.createCreditHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/credits/:credit_id", app.requirePermission("people:write", app.deleteCreditHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/people", app.requirePermission("movies:read", app.listPeopleHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/people", app.requirePermission("people:write", app.createPersonHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/people/:id", app.requirePermission("movies:read", app.showPersonHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/people/:id", app.requirePermission("people:write", app.updatePersonHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/people/:id", app.requirePermission("people:write", app.deletePersonHandler))
+
+	// The role management endpoints are only available to users with the roles:manage
+	// permission (which is granted to the admin role by default).
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("roles:manage", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/roles", app.requirePermission("roles:manage", app.createRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles/:id", app.requirePermission("roles:manage", app.showRoleHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/roles/:id", app.requirePermission("roles:manage", app.updateRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/roles/:id", app.requirePermission("roles:manage", app.deleteRoleHandler))
+	// The user management endpoints require the admin:users permission.
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("admin:users", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("admin:users", app.showUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission("admin:users", app.updateUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id", app.requirePermission("admin:users", app.deleteUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lock", app.requirePermission("admin:users", app.unlockUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("admin:users", app.showUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/permissions", app.requirePermission("admin:users", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions", app.requirePermission("admin:users", app.revokeUserPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/roles", app.requirePermission("roles:manage", app.showUserRolesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/users/:id/roles", app.requirePermission("roles:manage", app.updateUserRolesHandler))
+
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 	// Add the PUT /v1/users/password endpoint.
 	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.updateUserEmailHandler)
+
+	// The /v1/users/me endpoints let any authenticated user view and change their own
+	// profile. Apart from viewing the profile, they can't be used with an API key or an
+	// OAuth access token.
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireUserSession(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireUserSession(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireUserSession(app.deleteSessionHandler))
+
+	// Two-factor authentication enrollment and management.
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/mfa", app.requireActivatedUser(app.requireUserSession(app.beginMFAHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/mfa", app.requireActivatedUser(app.requireUserSession(app.confirmMFAHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/mfa", app.requireActivatedUser(app.requireUserSession(app.disableMFAHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/mfa/recovery-codes", app.requireActivatedUser(app.requireUserSession(app.regenerateRecoveryCodesHandler)))
+
+	// API keys for scripts and service accounts.
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireActivatedUser(app.requireUserSession(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireActivatedUser(app.requireUserSession(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireActivatedUser(app.requireUserSession(app.deleteAPIKeyHandler)))
+
+	// OAuth clients are registered by users, who can then act as the authorization
+	// server's consent screen for them. The token endpoint authenticates the client
+	// itself rather than a user.
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/clients", app.requireActivatedUser(app.requireUserSession(app.listOAuthClientsHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/clients", app.requireActivatedUser(app.requireUserSession(app.createOAuthClientHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/oauth/clients/:id", app.requireActivatedUser(app.requireUserSession(app.deleteOAuthClientHandler)))
+	router.HandlerFunc(http.MethodGet, "/oauth/authorize", app.requireActivatedUser(app.requireUserSession(app.showAuthorizationHandler)))
+	router.HandlerFunc(http.MethodPost, "/oauth/authorize", app.requireActivatedUser(app.requireUserSession(app.createAuthorizationHandler)))
+	router.HandlerFunc(http.MethodPost, "/oauth/token", app.createOAuthTokenHandler)
+
+	// The watchlist endpoints always act on the authenticated user's own watchlist.
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/watchlist", app.requirePermission("watchlist:manage", app.listWatchlistHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/watchlist/:movie_id", app.requirePermission("watchlist:manage", app.addWatchlistItemHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/watchlist/:movie_id", app.requirePermission("watchlist:manage", app.updateWatchlistItemHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/watchlist/:movie_id", app.requirePermission("watchlist:manage", app.removeWatchlistItemHandler))
+
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireUserSession(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFAAuthenticationTokenHandler)
+	// Passwordless login: request a login link by email, then redeem it.
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication/magic-link", app.createMagicLinkAuthenticationTokenHandler)
 	// Add the POST /v1/tokens/password-reset endpoint.
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 	// Add the POST /v1/tokens/activation endpoint.
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	// Changing email address requires an activated account, as the confirmation is
+	// sent as a token in the same way as activation and password reset.
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/email-change", app.requireActivatedUser(app.requireUserSession(app.createEmailChangeTokenHandler)))
 
 	router.Handler(http.MethodGet, "/v1/metrics", expvar.Handler())
+	// The same metrics (and more) in the Prometheus text format, for scraping.
+	router.Handler(http.MethodGet, "/metrics", app.prom.registry)
 
 	// Return the httprouter instance.”
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	// The per-route rate limits are applied after authentication, as they are tracked
+	// per user, with a coarse per-IP limit before it. The request ID and client IP are
+	// worked out first, so that they can be included in the access log written by
+	// metrics().
+	return app.requestID(app.realIP(app.metrics(app.recoverPanic(app.enableCORS(app.ipRateLimit(app.authenticate(app.rateLimit(router))))))))
 }
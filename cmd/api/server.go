@@ -24,6 +24,13 @@ func (app *application) serve() error {
 	// by the graceful Shutdown() function.
 	shutdownError := make(chan error)
 
+	// Start the email queue workers. They are stopped by cancelling mailCtx once the
+	// HTTP server has finished handling in-flight requests, so that any emails which
+	// those requests enqueued can still be picked up.
+	mailCtx, stopMail := context.WithCancel(context.Background())
+	defer stopMail()
+	app.runMailQueue(mailCtx)
+
 	go func() {
 		quit := make(chan os.Signal, 1)
 
@@ -45,6 +52,10 @@ func (app *application) serve() error {
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
+		// Tell the mail queue workers to stop claiming new jobs. Any job which is being
+		// delivered right now is allowed to finish before the worker exits, and jobs
+		// that are still pending stay in the database for the next start.
+		stopMail()
 		app.wg.Wait()
 		shutdownError <- nil
 	}()
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/shakilbd009/go-greenlight-api/internal/data"
@@ -47,20 +48,17 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Email the user with their additional activation token.
-	app.background(func() {
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-		}
-
-		// Since email addresses MAY be case sensitive, notice that we are sending this
-		// email using the address stored in our database for the user --- not to the
-		// input.Email address provided by the client in this request.
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
-	})
+	// Queue an email to the user with their additional activation token.
+	// Since email addresses MAY be case sensitive, notice that we are sending this
+	// email using the address stored in our database for the user --- not to the
+	// input.Email address provided by the client in this request.
+	payload := map[string]interface{}{
+		"activationToken": token.Plaintext,
+	}
+	if err := app.enqueueEmail(user.Email, "token_activation.tmpl", payload); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	// Send a 202 Accepted response and confirmation message to the client.
 	env := envelope{"message": "an email will be sent to you containing activation instructions"}
@@ -110,26 +108,134 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Email the user with their password reset token.
-	app.background(func() {
-		data := map[string]interface{}{
-			"passwordResetToken": token.Plaintext,
+	// Queue an email to the user with their password reset token.
+	payload := map[string]interface{}{
+		"passwordResetToken": token.Plaintext,
+	}
+	if err := app.enqueueEmail(user.Email, "token_password_reset.tmpl", payload); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Send a 202 Accepted response and confirmation message to the client.
+	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+	if err := app.writeJSON(w, http.StatusAccepted, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createMagicLinkTokenHandler emails a single-use login link to a user, which they
+// can redeem for an authentication token without entering their password. Only a
+// limited number of links can be requested for each email address in a window, so that
+// the endpoint can't be used to flood someone's inbox.
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if app.config.magicLink.limit > 0 {
+		policy := data.LoginPolicy{
+			Threshold:       app.config.magicLink.limit,
+			Window:          app.config.magicLink.window,
+			LockoutDuration: app.config.magicLink.window,
 		}
-		app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		// Record() counts the request and checks the limit in one go, so concurrent
+		// requests can't send more links than the limit allows.
+		requests, newlyLocked, err := app.models.LoginFailures.Record(data.LoginScopeMagicLink, strings.ToLower(input.Email), policy)
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.serverErrorResponse(w, r, err)
 			return
 		}
+		if requests.Locked && !newlyLocked {
+			app.magicLinkThrottledResponse(w, r, time.Until(*requests.LockedUntil))
+			return
+		}
+	}
 
-	})
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !user.Activated {
+		v.AddError("email", "user account must be activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	token, err := app.models.Tokens.New(user.ID, 15*time.Minute, data.ScopeLoginLink)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	payload := map[string]interface{}{
+		"loginToken": token.Plaintext,
+	}
+	if err := app.enqueueEmail(user.Email, "token_login_link.tmpl", payload); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	// Send a 202 Accepted response and confirmation message to the client.
-	env := envelope{"message": "an email will be sent to you containing password reset instructions"}
+	env := envelope{"message": "an email will be sent to you containing a login link"}
 	if err := app.writeJSON(w, http.StatusAccepted, env, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// The createMagicLinkAuthenticationTokenHandler redeems a login link token. Redeeming
+// one link invalidates any others which are still outstanding. Users with two-factor
+// authentication enabled still need to provide a code.
+func (app *application) createMagicLinkAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeLoginLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired login link token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if err := app.models.Tokens.DeleteAllForUser(data.ScopeLoginLink, user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// The account may have been deactivated since the link was sent.
+	if !user.Activated {
+		app.inactiveAccountResponse(w, r)
+		return
+	}
+	app.completeLogin(w, r, user)
+}
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email    string `json:"email"`
@@ -141,19 +247,30 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 	v := validator.New()
 	data.ValidateEmail(v, input.Email)
-	data.ValidatePasswordPlaintext(v, input.Password)
+	data.ValidateLoginPassword(v, input.Password)
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	// Refuse to check the password at all while the account or client IP address is
+	// locked out or still waiting out the delay after a failed login.
+	if !app.loginAllowed(w, r, input.Email) {
+		return
+	}
 
 	// Lookup the user record based on the email address. If no matching user was
 	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
 	// Unauthorized response to the client (we will create this helper in a moment).
+	// Failures are counted for unknown email addresses too, so that lockouts don't
+	// reveal which addresses have accounts.
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			if err := app.recordLoginFailure(r, input.Email, nil); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -166,18 +283,217 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 	if !match {
+		if err := app.recordLoginFailure(r, input.Email, user); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// Passwords hashed with an older algorithm or weaker parameters are upgraded now
+	// that we have the plaintext. This isn't essential, so a failure is only logged.
+	if user.Password.NeedsRehash() {
+		if err := app.models.Users.RehashPassword(user, input.Password); err != nil {
+			app.logError(r, err)
+		}
+	}
+	// The password was correct, so give back the attempt which was claimed for it.
+	if err := app.loginSucceeded(r, input.Email); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.completeLogin(w, r, user)
+}
+
+// The completeLogin() helper finishes a login once the user has proved who they are,
+// with their password or a login link. If the user has two-factor authentication
+// enabled, that alone isn't enough, so a short-lived mfa-pending token is sent instead,
+// which the client exchanges for an authentication token at POST /v1/tokens/mfa along
+// with a TOTP code.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	mfaEnabled, err := app.models.MFA.Enabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if mfaEnabled {
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeMFAPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env := envelope{"mfa_token": token, "message": "a two-factor authentication code is required"}
+		if err := app.writeJSON(w, http.StatusAccepted, env, nil); err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Otherwise we generate a short-lived authentication token along with a refresh
+	// token, which the client can exchange for new tokens without sending the
+	// password again.
+	app.issueSession(w, r, user, "")
+}
+
+// The refreshAuthenticationTokenHandler exchanges a refresh token for a new
+// authentication token and refresh token. The old refresh token can't be used again;
+// presenting it a second time revokes every token which descends from the same login.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	previous, err := app.models.Tokens.Rotate(input.RefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRefreshTokenReused):
+			app.revokeFamilyLocally(previous.Family)
+			app.logger.PrintInfo("refresh token reused; token family revoked", map[string]string{
+				"ip": app.clientIP(r),
+			})
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(previous.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !user.Activated {
+		app.inactiveAccountResponse(w, r)
+		return
+	}
+
+	app.issueSession(w, r, user, previous.Family)
+}
+
+// The deleteAuthenticationTokenHandler logs out the current session by revoking the
+// authentication token which the request was made with, along with its refresh token.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if claims := app.contextGetClaims(r); claims != nil {
+		// A JWT can't be deleted, so add it to the revocation list until it expires
+		// instead, and revoke the refresh token which was issued with it.
+		app.jwtRevoked.Revoke(claims.ID, claims.Expiry())
+		app.revokeFamilyLocally(claims.Family)
+		err = app.models.Tokens.RevokeFamily(claims.Family)
+	} else {
+		err = app.models.Tokens.RevokeSession(app.contextGetToken(r))
+	}
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	app.writeJSON(w, http.StatusCreated, envelope{
-		"authentication_token": token,
-	}, nil)
+	env := envelope{"message": "authentication token successfully revoked"}
+	if err := app.writeJSON(w, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createEmailChangeTokenHandler starts an email address change for the authenticated
+// user. The new address isn't saved on the user record until the token which we send to
+// it is redeemed, which proves that the user controls that address.
+func (app *application) createEmailChangeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.currentUserErrorResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		Email           string `json:"email"`
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	data.ValidateEmail(v, input.Email)
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v.Check(match, "current_password", "is incorrect")
+	v.Check(!strings.EqualFold(input.Email, user.Email), "email", "must be different from your current email address")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
 
+	// Check up front that the new address isn't already taken. This is repeated when the
+	// token is redeemed, as the address could be registered in the meantime.
+	_, err = app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Only the most recently requested change can be confirmed, so delete any earlier
+	// email-change tokens before creating a new one.
+	if err := app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token, err := app.models.Tokens.NewEmailChange(user.ID, 24*time.Hour, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Send the token to the new address, and let the old address know that a change has
+	// been requested in case it wasn't the account owner who asked for it.
+	payload := map[string]interface{}{
+		"emailChangeToken": token.Plaintext,
+	}
+	if err := app.enqueueEmail(input.Email, "token_email_change.tmpl", payload); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	payload = map[string]interface{}{
+		"newEmail": input.Email,
+	}
+	if err := app.enqueueEmail(user.Email, "email_change_notice.tmpl", payload); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "an email will be sent to the new address containing confirmation instructions"}
+	if err := app.writeJSON(w, http.StatusAccepted, env, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
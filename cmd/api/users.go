@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/shakilbd009/go-greenlight-api/internal/data"
@@ -38,6 +40,11 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
+		return
+	}
+	if data.ValidatePasswordPolicy(v, input.Password, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
 	// Set the new password for the user.
 	if err := user.Password.Set(input.Password); err != nil {
@@ -59,6 +66,12 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	// The password may have been reset because the account was compromised, so log the
+	// user out of all their existing sessions too.
+	if err := app.revokeAllSessions(user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 	// Send the user a confirmation message.
 	env := envelope{"message": "your password was successfully reset"}
 	err = app.writeJSON(w, http.StatusOK, env, nil)
@@ -169,8 +182,11 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-	if err := app.models.Permissions.AddForUser(user.ID, "movies:read"); err != nil {
-		app.serverErrorResponse(w, r, err)
+	// Give the new user the default role, which grants the permissions that every user
+	// starts out with.
+	// The role is checked at startup, but it could have been deleted since.
+	if err := app.models.Roles.AddForUser(user.ID, app.config.auth.defaultRole); err != nil {
+		app.serverErrorResponse(w, r, fmt.Errorf("granting default role %q: %w", app.config.auth.defaultRole, err))
 		return
 	}
 	// After the user record has been created in the database, generate a new activation
@@ -181,22 +197,20 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Call the Send() method on our Mailer, passing in the user's email address,
-	// name of the template file, and the User struct containing the new user's data.
-	app.background(func() {
-		// As there are now multiple pieces of data that we want to pass to our email
-		// templates, we create a map to act as a 'holding structure' for the data. This
-		// contains the plaintext version of the activation token for the user, along // with their ID.
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext, "userID": user.ID}
-
-		if err := app.mailer.Send(user.Email, "user_welcome.tmpl", data); err != nil {
-			// Importantly, if there is an error sending the email then we use the
-			// app.logger.PrintError() helper to manage it, instead of the
-			// app.serverErrorResponse() helper like before.
-			app.logger.PrintError(err, nil)
-		}
-	})
+	// Queue the welcome email, passing in the user's email address, the name of the
+	// template file, and the data for the template. The job is persisted before we
+	// respond, so the email won't be lost if the process stops before it is delivered.
+	// As there are now multiple pieces of data that we want to pass to our email
+	// templates, we create a map to act as a 'holding structure' for the data. This
+	// contains the plaintext version of the activation token for the user, along with
+	// their ID. The ID is formatted as a string, as the payload is stored as JSON and a
+	// number would come back as a float64, which the template prints as 1e+06.
+	payload := map[string]interface{}{
+		"activationToken": token.Plaintext, "userID": strconv.FormatInt(user.ID, 10)}
+	if err := app.enqueueEmail(user.Email, "user_welcome.tmpl", payload); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	//note that we also change this to send the client a 202 Accepted status code.
 	//this indicates, request has been accepted for processing.
@@ -206,3 +220,211 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The showCurrentUserHandler returns the profile of the authenticated user, along with
+// their effective permissions.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.currentUserErrorResponse(w, r, err)
+		return
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateCurrentUserHandler lets the authenticated user change their name and/or
+// password. Changing the password requires the current password to be provided too.
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.currentUserErrorResponse(w, r, err)
+		return
+	}
+
+	var input struct {
+		Name            *string `json:"name"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+	if input.Password != nil {
+		// Check the current password before accepting a new one, so that someone who
+		// gets hold of an authentication token can't use it to take over the account.
+		v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+		if input.CurrentPassword != "" {
+			match, err := user.Password.Matches(input.CurrentPassword)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			v.Check(match, "current_password", "is incorrect")
+		}
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+		if err := user.Password.Set(*input.Password); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The user was read from the database when the request was authenticated, so the
+	// version check in Update() will catch any changes made since then.
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Any outstanding password reset tokens are no longer needed once the password has
+	// been changed. The user's other sessions are logged out too, as they may have been
+	// started by whoever knew the old password; only the session making this request is
+	// kept. Access granted to OAuth clients isn't affected.
+	if input.Password != nil {
+		if err := app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		var family string
+		if claims := app.contextGetClaims(r); claims != nil {
+			family = claims.Family
+		}
+		families, err := app.models.Tokens.DeleteOtherSessions(user.ID, app.contextGetToken(r), family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, family := range families {
+			app.revokeFamilyLocally(family)
+		}
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateUserEmailHandler redeems an email-change token, switching the user's email
+// address to the one which was recorded when the token was created.
+func (app *application) updateUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, newEmail, err := app.models.Users.GetForEmailChangeToken(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user.Email = newEmail
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// The change has been made, so delete all email-change tokens for the user.
+	if err := app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listSessionsHandler returns the active authentication tokens for the current user.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	var family string
+	if claims := app.contextGetClaims(r); claims != nil {
+		family = claims.Family
+	}
+	sessions, err := app.models.Tokens.GetAllSessionsForUser(user.ID, app.sessionScope(), app.contextGetToken(r), family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err := app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteSessionHandler revokes one of the current user's sessions, for example to
+// sign out a device which they no longer use.
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	family, err := app.models.Tokens.DeleteSession(app.contextGetUser(r).ID, id, app.sessionScope())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.revokeFamilyLocally(family)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
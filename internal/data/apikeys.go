@@ -0,0 +1,231 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/shakilbd009/go-greenlight-api/internal/validator"
+)
+
+// APIKeyPrefix starts every API key, so that keys are easy to recognize (for example by
+// secret scanners) and can't be confused with tokens.
+const APIKeyPrefix = "glk_"
+
+// API keys are "glk_<prefix>_<secret>". The prefix is stored in plaintext so that keys
+// can be identified in listings and logs; the key as a whole is only stored hashed.
+const (
+	apiKeyPrefixLength = 8
+	apiKeySecretLength = 32
+)
+
+var apiKeyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// APIKey is a long-lived credential for scripts and service accounts. It acts on behalf
+// of its owner, but only with its own permissions, which must be a subset of the
+// owner's. The Plaintext field is only set when the key is created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	ExpiresAt   *time.Time  `json:"expires_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// ValidateAPIKey checks the fields of a new API key. The ownerPermissions argument
+// should hold the owner's effective permissions, as a key can't be given any which the
+// owner doesn't have.
+func ValidateAPIKey(v *validator.Validator, key *APIKey, ownerPermissions Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range key.Permissions {
+		v.Check(ownerPermissions.Include(code), "permissions", "must only contain permissions which you hold")
+	}
+	if key.ExpiresAt != nil {
+		v.Check(key.ExpiresAt.After(time.Now()), "expires_at", "must be in the future")
+	}
+}
+
+// ValidateAPIKeyPlaintext checks that a string has the format of an API key.
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(plaintext != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(plaintext, APIKeyPrefix), "key", "must be an API key")
+	v.Check(len(plaintext) == len(APIKeyPrefix)+apiKeyPrefixLength+1+apiKeySecretLength, "key", "must be an API key")
+}
+
+// Define the APIKeyModel type.
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// New() generates a key and stores it, along with its permissions.
+func (m APIKeyModel) New(key *APIKey) error {
+	if err := generateAPIKey(key); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+INSERT INTO api_keys (user_id, name, prefix, hash, expires_at)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, created_at`
+	args := []interface{}{key.UserID, key.Name, key.Prefix, key.Hash, key.ExpiresAt}
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt); err != nil {
+		return err
+	}
+	query = `
+INSERT INTO api_keys_permissions
+SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+	if _, err := tx.ExecContext(ctx, query, key.ID, pq.Array([]string(key.Permissions))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAllForUser() returns all of a user's API keys, including expired ones, newest
+// first.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+SELECT api_keys.id, api_keys.user_id, api_keys.name, api_keys.prefix, api_keys.created_at,
+	api_keys.expires_at, api_keys.last_used_at,
+	COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+FROM api_keys
+LEFT JOIN api_keys_permissions ON api_keys_permissions.api_key_id = api_keys.id
+LEFT JOIN permissions ON api_keys_permissions.permission_id = permissions.id
+WHERE api_keys.user_id = $1
+GROUP BY api_keys.id
+ORDER BY api_keys.id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			&key.CreatedAt,
+			&key.ExpiresAt,
+			&key.LastUsedAt,
+			pq.Array((*[]string)(&key.Permissions)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// GetForPlaintext() looks up an unexpired API key, returning it along with its owner.
+func (m APIKeyModel) GetForPlaintext(plaintext string) (*User, *APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version,
+	api_keys.id, api_keys.name, api_keys.prefix, api_keys.created_at, api_keys.expires_at, api_keys.last_used_at,
+	COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+FROM api_keys
+INNER JOIN users ON users.id = api_keys.user_id
+LEFT JOIN api_keys_permissions ON api_keys_permissions.api_key_id = api_keys.id
+LEFT JOIN permissions ON api_keys_permissions.permission_id = permissions.id
+WHERE api_keys.hash = $1
+AND (api_keys.expires_at IS NULL OR api_keys.expires_at > NOW())
+GROUP BY users.id, api_keys.id`
+	var user User
+	var key APIKey
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version,
+		&key.ID, &key.Name, &key.Prefix, &key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt,
+		pq.Array((*[]string)(&key.Permissions)),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	key.UserID = user.ID
+	return &user, &key, nil
+}
+
+// Touch() records that an API key has just been used. Like TokenModel.Touch(), it
+// only writes once a minute at most.
+func (m APIKeyModel) Touch(id int64) error {
+	query := `
+UPDATE api_keys
+SET last_used_at = NOW()
+WHERE id = $1
+AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// Delete() revokes one of a user's API keys.
+func (m APIKeyModel) Delete(userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+DELETE FROM api_keys WHERE id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func generateAPIKey(key *APIKey) error {
+	random := make([]byte, 25)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	encoded := strings.ToLower(apiKeyEncoding.EncodeToString(random))
+	key.Prefix = APIKeyPrefix + encoded[:apiKeyPrefixLength]
+	key.Plaintext = key.Prefix + "_" + encoded[apiKeyPrefixLength:apiKeyPrefixLength+apiKeySecretLength]
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+	return nil
+}
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Define an error that decodeCursor() returns for any cursor which is malformed, has
+// been tampered with, or was signed with a different key.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursor holds the position of a row in a keyset-paginated result set. Value is the
+// row's value for the sort column (always encoded as a string, so that PostgreSQL can
+// infer the type from the column it is compared with) and ID breaks any ties. Backward
+// is set for cursors that point to the previous page rather than the next one.
+type cursor struct {
+	Sort     string `json:"s"`
+	Value    string `json:"v"`
+	ID       int64  `json:"id"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+// encodeCursor() serializes a cursor to an opaque, URL-safe string in the format
+// "<payload>.<signature>", where the signature is a HMAC-SHA256 of the payload.
+func (f Filters) encodeCursor(value string, id int64, backward bool) string {
+	payload, err := json.Marshal(cursor{Sort: f.Sort, Value: value, ID: id, Backward: backward})
+	if err != nil {
+		// Marshaling a struct containing only strings, ints and bools can't fail, so
+		// this would be a logic error in our code.
+		panic(err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(f.signCursor(encoded))
+}
+
+// decodeCursor() verifies and parses the Cursor field. It returns nil if no cursor was
+// provided, and ErrInvalidCursor if the signature doesn't match or the cursor was
+// created for a different sort order.
+func (f Filters) decodeCursor() (*cursor, error) {
+	if f.Cursor == "" {
+		return nil, nil
+	}
+	parts := strings.Split(f.Cursor, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if !hmac.Equal(signature, f.signCursor(parts[0])) {
+		return nil, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != f.Sort || c.ID < 1 {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+func (f Filters) signCursor(payload string) []byte {
+	if len(f.CursorKey) == 0 {
+		panic("missing cursor signing key")
+	}
+	mac := hmac.New(sha256.New, f.CursorKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// keysetClause() returns the WHERE condition and ORDER BY clause for fetching the rows
+// which come after (or, for a backward cursor, before) the cursor position. The
+// valueParam and idParam arguments are the numbers of the placeholder parameters that
+// will hold the cursor value and ID. Note that for backward cursors the ordering is
+// reversed, so the caller needs to reverse the rows it reads back.
+func (f Filters) keysetClause(c *cursor, valueParam, idParam int) (string, string) {
+	column := f.sortColumn()
+	direction := f.sortDirection()
+
+	after, idAfter, idOrder := ">", ">", "ASC"
+	if direction == "DESC" {
+		after = "<"
+	}
+	if c.Backward {
+		after = map[string]string{">": "<", "<": ">"}[after]
+		idAfter, idOrder = "<", "DESC"
+		direction = map[string]string{"ASC": "DESC", "DESC": "ASC"}[direction]
+	}
+
+	where := fmt.Sprintf("(%[1]s %[2]s $%[3]d OR (%[1]s = $%[3]d AND id %[4]s $%[5]d))",
+		column, after, valueParam, idAfter, idParam)
+	orderBy := fmt.Sprintf("%s %s, id %s", column, direction, idOrder)
+	return where, orderBy
+}
@@ -0,0 +1,188 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Define constants for the lifecycle states of an email job. A job starts out pending,
+// is marked as sending while a worker holds it, and finishes as either sent or failed
+// (once it has used up all of its delivery attempts).
+const (
+	EmailJobPending = "pending"
+	EmailJobSending = "sending"
+	EmailJobSent    = "sent"
+	EmailJobFailed  = "failed"
+)
+
+// EmailJob represents a single outbound email waiting in (or having passed through) the
+// email_jobs queue. The Data field holds the dynamic data for the template, which is
+// stored as JSONB in the database.
+type EmailJob struct {
+	ID          int64                  `json:"id"`
+	CreatedAt   time.Time              `json:"created_at"`
+	Recipient   string                 `json:"recipient"`
+	Template    string                 `json:"template"`
+	Data        map[string]interface{} `json:"-"`
+	Status      string                 `json:"status"`
+	Attempts    int                    `json:"attempts"`
+	MaxAttempts int                    `json:"max_attempts"`
+	LastError   string                 `json:"last_error,omitempty"`
+	RunAt       time.Time              `json:"run_at"`
+}
+
+// Define the EmailJobModel type.
+type EmailJobModel struct {
+	DB *sql.DB
+}
+
+// Insert() adds a new pending job to the queue. The job becomes eligible to be claimed
+// by a worker straight away.
+func (m EmailJobModel) Insert(job *EmailJob) error {
+	payload, err := json.Marshal(job.Data)
+	if err != nil {
+		return err
+	}
+	if job.MaxAttempts < 1 {
+		job.MaxAttempts = 8
+	}
+	query := `
+INSERT INTO email_jobs (recipient, template, data, max_attempts)
+VALUES ($1, $2, $3, $4)
+RETURNING id, created_at, status, run_at`
+	args := []interface{}{job.Recipient, job.Template, payload, job.MaxAttempts}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&job.ID, &job.CreatedAt, &job.Status, &job.RunAt)
+}
+
+// Claim() atomically takes up to limit jobs which are due to run and marks them as
+// sending. The FOR UPDATE SKIP LOCKED clause means that several workers (or several API
+// instances) can claim jobs concurrently without ever picking up the same row. Jobs
+// which have been stuck in the sending state for longer than staleAfter are assumed to
+// belong to a worker which crashed, and are claimed again.
+func (m EmailJobModel) Claim(limit int, staleAfter time.Duration) ([]*EmailJob, error) {
+	query := `
+UPDATE email_jobs
+SET status = 'sending', locked_at = NOW(), attempts = attempts + 1
+WHERE id IN (
+	SELECT id FROM email_jobs
+	WHERE (status = 'pending' AND run_at <= NOW())
+	OR (status = 'sending' AND locked_at < $2)
+	ORDER BY run_at, id
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING id, created_at, recipient, template, data, status, attempts, max_attempts, last_error, run_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, limit, time.Now().Add(-staleAfter))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []*EmailJob{}
+	for rows.Next() {
+		var job EmailJob
+		var payload []byte
+		err := rows.Scan(
+			&job.ID,
+			&job.CreatedAt,
+			&job.Recipient,
+			&job.Template,
+			&payload,
+			&job.Status,
+			&job.Attempts,
+			&job.MaxAttempts,
+			&job.LastError,
+			&job.RunAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(payload, &job.Data); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// MarkSent() records that a job was delivered successfully. The template data is
+// cleared, as it can contain plaintext tokens (such as activation and password reset
+// tokens) which shouldn't be kept once they have been sent.
+func (m EmailJobModel) MarkSent(id int64) error {
+	query := `
+UPDATE email_jobs
+SET status = 'sent', sent_at = NOW(), locked_at = NULL, last_error = '', data = '{}'
+WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// MarkFailed() records a failed delivery attempt. If the job still has attempts left
+// it goes back to pending and will become due again at runAt, otherwise it is parked in
+// the failed state for an operator to look at. As a failed job will never be sent, its
+// template data is cleared, for the same reason as in MarkSent().
+func (m EmailJobModel) MarkFailed(job *EmailJob, sendErr error, runAt time.Time) error {
+	if sendErr == nil {
+		return errors.New("missing error for failed email job")
+	}
+	job.Status = EmailJobPending
+	if job.Attempts >= job.MaxAttempts {
+		job.Status = EmailJobFailed
+	}
+	job.LastError = sendErr.Error()
+	job.RunAt = runAt
+	query := `
+UPDATE email_jobs
+SET status = $1::text, last_error = $2, run_at = $3, locked_at = NULL,
+	data = CASE WHEN $1::text = 'failed' THEN '{}'::jsonb ELSE data END
+WHERE id = $4`
+	args := []interface{}{job.Status, job.LastError, job.RunAt, job.ID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// CountPending() returns the number of jobs which are waiting to be delivered, including
+// those which are being sent right now.
+func (m EmailJobModel) CountPending() (int, error) {
+	query := `
+SELECT count(*) FROM email_jobs
+WHERE status IN ('pending', 'sending')`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var count int
+	err := m.DB.QueryRowContext(ctx, query).Scan(&count)
+	return count, err
+}
@@ -12,14 +12,21 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	// Cursor holds the opaque keyset pagination cursor sent by the client (if any), and
+	// CursorKey is the secret used to sign and verify cursors. Endpoints which don't
+	// support cursor pagination can leave both empty.
+	Cursor    string
+	CursorKey []byte
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 // The calculateMetadata() function calculates the appropriate pagination metadata
@@ -47,6 +54,14 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+
+	// A cursor already identifies the position in the results, so it can't be combined
+	// with a page number. It must also have been issued for the same sort order.
+	if f.Cursor != "" {
+		v.Check(f.Page == 1, "page", "must not be provided with a cursor")
+		_, err := f.decodeCursor()
+		v.Check(err == nil, "cursor", "invalid cursor value")
+	}
 }
 
 // Check that the client-provided Sort field matches one of the entries in our safelist // and if it does, extract the column name from the Sort field by stripping the leading // hyphen character (if one exists).
@@ -0,0 +1,270 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Define the scopes which failed logins are counted under: per account (keyed by the
+// lowercased email address) and per client IP address. LoginScopeMagicLink counts
+// requests for login links rather than failures, so that the same lockout mechanism
+// can limit how many emails are sent to an address.
+const (
+	LoginScopeAccount   = "account"
+	LoginScopeIP        = "ip"
+	LoginScopeMagicLink = "magic-link"
+)
+
+// LoginFailure holds the count of recent failed logins for an account or IP address,
+// and the time until which further attempts are locked out.
+type LoginFailure struct {
+	Failures      int        `json:"failures"`
+	LastFailureAt *time.Time `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+	Locked        bool       `json:"locked"`
+}
+
+// LoginPolicy controls how failed logins are counted. Failures older than Window are
+// forgotten, and reaching Threshold failures locks the account or IP out for
+// LockoutDuration. After each failure, further attempts must wait for Delay, which
+// doubles with every consecutive failure up to MaxDelay.
+type LoginPolicy struct {
+	Threshold       int
+	Window          time.Duration
+	LockoutDuration time.Duration
+	Delay           time.Duration
+	MaxDelay        time.Duration
+}
+
+// DelayAfter() returns how long a client must wait before trying again after the given
+// number of consecutive failures.
+func (p LoginPolicy) DelayAfter(failures int) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+	delay := p.Delay
+	for i := 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Define the LoginFailureModel type.
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// Get() returns the failed login record for a key. If there have been no recent
+// failures, a zero-valued record is returned.
+func (m LoginFailureModel) Get(scope, key string, window time.Duration) (*LoginFailure, error) {
+	query := `
+SELECT failures, last_failure_at, locked_until
+FROM login_failures
+WHERE scope = $1 AND key = $2`
+	var lf LoginFailure
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, scope, key).Scan(&lf.Failures, &lf.LastFailureAt, &lf.LockedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return &LoginFailure{}, nil
+		default:
+			return nil, err
+		}
+	}
+	now := time.Now()
+	lf.Locked = lf.LockedUntil != nil && now.Before(*lf.LockedUntil)
+	// Failures outside of the window no longer count, unless the lockout which they
+	// caused is still running.
+	if !lf.Locked && lf.LastFailureAt.Before(now.Add(-window)) {
+		return &LoginFailure{}, nil
+	}
+	return &lf, nil
+}
+
+// Record() counts a failed login (or other attempt) for a key, locking it out if the
+// policy threshold has been reached. The updated record is returned, along with whether
+// this failure started a new lockout. If the key is already locked out, nothing is
+// counted: the record is returned with Locked set, and newlyLocked false. The check and
+// the count are made in one statement, so concurrent calls can't both get in under the
+// threshold.
+func (m LoginFailureModel) Record(scope, key string, policy LoginPolicy) (*LoginFailure, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	query := `
+INSERT INTO login_failures (scope, key, failures, last_failure_at)
+VALUES ($1, $2, 1, $3)
+ON CONFLICT (scope, key) DO UPDATE
+SET failures = CASE
+		WHEN login_failures.last_failure_at < $4 THEN 1
+		ELSE login_failures.failures + 1
+	END,
+	last_failure_at = $3
+WHERE login_failures.locked_until IS NULL OR login_failures.locked_until <= $3
+RETURNING failures, last_failure_at, locked_until`
+	var lf LoginFailure
+	err = tx.QueryRowContext(ctx, query, scope, key, now, now.Add(-policy.Window)).Scan(
+		&lf.Failures, &lf.LastFailureAt, &lf.LockedUntil,
+	)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, false, err
+		}
+		query = `
+SELECT failures, last_failure_at, locked_until FROM login_failures WHERE scope = $1 AND key = $2`
+		if err := tx.QueryRowContext(ctx, query, scope, key).Scan(&lf.Failures, &lf.LastFailureAt, &lf.LockedUntil); err != nil {
+			return nil, false, err
+		}
+		lf.Locked = true
+		return &lf, false, tx.Commit()
+	}
+
+	locked := lf.LockedUntil != nil && now.Before(*lf.LockedUntil)
+	newlyLocked := false
+	if !locked && policy.Threshold > 0 && lf.Failures >= policy.Threshold {
+		lockedUntil := now.Add(policy.LockoutDuration)
+		query = `
+UPDATE login_failures SET locked_until = $3 WHERE scope = $1 AND key = $2`
+		if _, err := tx.ExecContext(ctx, query, scope, key, lockedUntil); err != nil {
+			return nil, false, err
+		}
+		lf.LockedUntil = &lockedUntil
+		locked, newlyLocked = true, true
+	}
+	lf.Locked = locked
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return &lf, newlyLocked, nil
+}
+
+// Reserve() claims a login attempt for a key. Checking the lockout and then counting a
+// failure afterwards would let concurrent requests all pass the check before any of
+// them is counted, so instead the attempt is counted as a failure up front, in the same
+// statement which checks that the key isn't locked and that the delay after the
+// previous attempt has passed. The delay for the next attempt starts straight away.
+//
+// If the attempt is allowed, the zero time is returned. Otherwise nothing is counted,
+// and the time at which the key may try again is returned. A successful login should
+// call Clear() or Release() to give back the failure which was counted.
+func (m LoginFailureModel) Reserve(scope, key string, policy LoginPolicy) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	// The upsert locks the row until the transaction commits, so a concurrent attempt
+	// waits here and then sees the new next_allowed_at.
+	now := time.Now()
+	query := `
+INSERT INTO login_failures (scope, key, failures, last_failure_at)
+VALUES ($1, $2, 1, $3)
+ON CONFLICT (scope, key) DO UPDATE
+SET failures = CASE
+		WHEN login_failures.last_failure_at < $4 THEN 1
+		ELSE login_failures.failures + 1
+	END,
+	last_failure_at = $3
+WHERE (login_failures.locked_until IS NULL OR login_failures.locked_until <= $3)
+AND (login_failures.next_allowed_at IS NULL OR login_failures.next_allowed_at <= $3)
+RETURNING failures`
+	var failures int
+	err = tx.QueryRowContext(ctx, query, scope, key, now, now.Add(-policy.Window)).Scan(&failures)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, err
+		}
+		// The attempt isn't allowed yet, so work out when it will be.
+		query = `
+SELECT locked_until, next_allowed_at FROM login_failures WHERE scope = $1 AND key = $2`
+		var lockedUntil, nextAllowedAt *time.Time
+		if err := tx.QueryRowContext(ctx, query, scope, key).Scan(&lockedUntil, &nextAllowedAt); err != nil {
+			return time.Time{}, err
+		}
+		retryAt := now
+		for _, t := range []*time.Time{lockedUntil, nextAllowedAt} {
+			if t != nil && t.After(retryAt) {
+				retryAt = *t
+			}
+		}
+		return retryAt, tx.Commit()
+	}
+
+	query = `
+UPDATE login_failures SET next_allowed_at = $3 WHERE scope = $1 AND key = $2`
+	if _, err := tx.ExecContext(ctx, query, scope, key, now.Add(policy.DelayAfter(failures))); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, tx.Commit()
+}
+
+// Lock() locks a key out if the failures counted by Reserve() have reached the policy
+// threshold. It should be called once a reserved attempt has failed. The record is
+// returned along with true if this started a new lockout; otherwise it returns nil and
+// false.
+func (m LoginFailureModel) Lock(scope, key string, policy LoginPolicy) (*LoginFailure, bool, error) {
+	if policy.Threshold < 1 {
+		return nil, false, nil
+	}
+	now := time.Now()
+	query := `
+UPDATE login_failures SET locked_until = $3
+WHERE scope = $1 AND key = $2 AND failures >= $4
+AND (locked_until IS NULL OR locked_until <= $5)
+RETURNING failures, last_failure_at, locked_until`
+	var lf LoginFailure
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, scope, key, now.Add(policy.LockoutDuration), policy.Threshold, now).Scan(
+		&lf.Failures, &lf.LastFailureAt, &lf.LockedUntil,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, false, nil
+		default:
+			return nil, false, err
+		}
+	}
+	lf.Locked = true
+	return &lf, true, nil
+}
+
+// Release() gives back an attempt claimed by Reserve() which turned out to be a
+// successful login, for keys whose count shouldn't be cleared by a success.
+func (m LoginFailureModel) Release(scope, key string) error {
+	query := `
+UPDATE login_failures
+SET failures = GREATEST(failures - 1, 0), next_allowed_at = NULL
+WHERE scope = $1 AND key = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, scope, key)
+	return err
+}
+
+// Clear() forgets the failed logins for a key, lifting any lockout.
+func (m LoginFailureModel) Clear(scope, key string) error {
+	query := `
+DELETE FROM login_failures WHERE scope = $1 AND key = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, scope, key)
+	return err
+}
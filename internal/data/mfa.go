@@ -0,0 +1,252 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Define an ErrMFAEnabled error, returned when starting enrollment for a user who has
+// already confirmed two-factor authentication.
+var (
+	ErrMFAEnabled = errors.New("mfa already enabled")
+)
+
+// RecoveryCodeCount is the number of recovery codes generated for each user.
+const RecoveryCodeCount = 10
+
+// MFA holds a user's TOTP secret. LastUsedStep is the most recent time step for which
+// a code was accepted, so that codes can't be replayed.
+type MFA struct {
+	UserID       int64
+	Secret       []byte
+	Confirmed    bool
+	LastUsedStep int64
+}
+
+// Define the MFAModel type.
+type MFAModel struct {
+	DB *sql.DB
+}
+
+// Begin() stores a new, unconfirmed TOTP secret for a user, replacing any earlier
+// unconfirmed one. It returns ErrMFAEnabled if the user has already confirmed MFA.
+func (m MFAModel) Begin(userID int64, secret []byte) error {
+	query := `
+INSERT INTO users_mfa (user_id, secret)
+VALUES ($1, $2)
+ON CONFLICT (user_id) DO UPDATE
+SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()
+WHERE users_mfa.confirmed = false`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrMFAEnabled
+	}
+	return nil
+}
+
+// Get() retrieves the MFA record for a user, confirmed or not.
+func (m MFAModel) Get(userID int64) (*MFA, error) {
+	query := `
+SELECT user_id, secret, confirmed, last_used_step
+FROM users_mfa
+WHERE user_id = $1`
+	var mfa MFA
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&mfa.UserID, &mfa.Secret, &mfa.Confirmed, &mfa.LastUsedStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &mfa, nil
+}
+
+// Enabled() reports whether a user has confirmed MFA.
+func (m MFAModel) Enabled(userID int64) (bool, error) {
+	query := `
+SELECT EXISTS(SELECT 1 FROM users_mfa WHERE user_id = $1 AND confirmed)`
+	var enabled bool
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// Confirm() marks a user's MFA as confirmed, recording the step of the code which was
+// used to confirm it, and replaces their recovery codes with a newly generated set. The
+// plaintext recovery codes are returned; only their hashes are stored.
+func (m MFAModel) Confirm(userID, step int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+UPDATE users_mfa
+SET confirmed = true, last_used_step = $2
+WHERE user_id = $1 AND confirmed = false AND last_used_step < $2`
+	result, err := tx.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrEditConflict
+	}
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// UseStep() records that a code for the given time step has been accepted. It returns
+// false if a code for this step (or a later one) was already used.
+func (m MFAModel) UseStep(userID, step int64) (bool, error) {
+	query := `
+UPDATE users_mfa
+SET last_used_step = $2
+WHERE user_id = $1 AND last_used_step < $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode() marks a recovery code as used. It returns false if the code is
+// unknown or has already been used.
+func (m MFAModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+UPDATE mfa_recovery_codes
+SET used_at = NOW()
+WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+	hash := hashRecoveryCode(code)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, hash)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// RegenerateRecoveryCodes() replaces a user's recovery codes with a new set.
+func (m MFAModel) RegenerateRecoveryCodes(userID int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable() removes a user's TOTP secret and recovery codes.
+func (m MFAModel) Disable(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users_mfa WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int64) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([][]byte, RecoveryCodeCount)
+	for i := range codes {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		hashes[i] = hashRecoveryCode(code)
+	}
+	query := `
+INSERT INTO mfa_recovery_codes (hash, user_id)
+SELECT unnest($2::bytea[]), $1`
+	if _, err := tx.ExecContext(ctx, query, userID, pq.ByteaArray(hashes)); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode() returns a random code in the format "xxxx-xxxx-xxxx-xxxx".
+// The codes have 80 bits of entropy, so (like tokens) a fast hash is enough to store
+// them safely.
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	return s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16], nil
+}
+
+// hashRecoveryCode() normalizes a recovery code, so that users can enter it with or
+// without the dashes and in either case, then hashes it.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
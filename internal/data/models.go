@@ -16,18 +16,42 @@ var (
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and PermissionModel, as our build progresses.
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies        MovieModel
+	Users         UserModel
+	Tokens        TokenModel
+	Permissions   PermissionModel
+	EmailJobs     EmailJobModel
+	Reviews       ReviewModel
+	Watchlist     WatchlistModel
+	People        PersonModel
+	Credits       CreditModel
+	Roles         RoleModel
+	LoginFailures LoginFailureModel
+	MFA           MFAModel
+	APIKeys       APIKeyModel
+	OAuthClients  OAuthClientModel
+	OAuthCodes    OAuthCodeModel
+	RateLimits    RateLimitModel
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing // the initialized MovieModel.
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:        MovieModel{DB: db},
+		Users:         UserModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		EmailJobs:     EmailJobModel{DB: db},
+		Reviews:       ReviewModel{DB: db},
+		Watchlist:     WatchlistModel{DB: db},
+		People:        PersonModel{DB: db},
+		Credits:       CreditModel{DB: db},
+		Roles:         RoleModel{DB: db},
+		LoginFailures: LoginFailureModel{DB: db},
+		MFA:           MFAModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		OAuthClients:  OAuthClientModel{DB: db},
+		OAuthCodes:    OAuthCodeModel{DB: db},
+		RateLimits:    RateLimitModel{DB: db},
 	}
 }
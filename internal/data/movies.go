@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/lib/pq"
@@ -18,7 +19,13 @@ type Movie struct {
 	Year      int32     `json:"year,omitempty"`
 	Runtime   Runtime   `json:"runtime,omitempty"`
 	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	// The aggregated rating fields are maintained by the ReviewModel whenever a review
+	// is added, changed or removed.
+	AverageRating float64 `json:"average_rating"`
+	ReviewCount   int32   `json:"review_count"`
+	Version       int32   `json:"version"`
+	// Credits is only populated when a client asks for it to be embedded.
+	Credits []*Credit `json:"credits,omitempty"`
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -38,6 +45,12 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 }
 
+// creditSubquery is the correlated subquery that GetAll() uses to match movies against
+// the people filters.
+const creditSubquery = `SELECT 1 FROM movie_credits
+	INNER JOIN people ON movie_credits.person_id = people.id
+	WHERE movie_credits.movie_id = movies.id`
+
 // Define a MovieModel struct type which wraps a sql.DB connection pool.
 type MovieModel struct {
 	DB *sql.DB
@@ -80,7 +93,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	}
 	// Define the SQL query for retrieving the movie data.
 	query := `
-	SELECT  id, created_at, title, year, runtime, genres, version FROM movies
+	SELECT  id, created_at, title, year, runtime, genres, average_rating, review_count, version FROM movies
 	WHERE id = $1`
 	// Declare a Movie struct to hold the data returned by the query.
 	var movie Movie
@@ -101,6 +114,8 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Year,
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
+		&movie.AverageRating,
+		&movie.ReviewCount,
 		&movie.Version,
 	)
 	// Handle any errors. If there was no matching movie found, Scan() will return
@@ -177,22 +192,52 @@ func (m MovieModel) Delete(id int64) error {
 
 // Create a new GetAll() method which returns a slice of movies. Although we're not
 // using them right now, we've set this up to accept the various filter parameters as
-// arguments.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	// Construct the SQL query to retrieve all movie records.
-	query := fmt.Sprintf(`
-SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+// arguments. The people filters restrict the results to movies where a person with a
+// matching name is credited in the given role.
+func (m MovieModel) GetAll(title string, genres []string, people CreditFilters, filters Filters) ([]*Movie, Metadata, error) {
+	// Decode the keyset pagination cursor, if the client sent one. This will already
+	// have been checked by ValidateFilters(), so any error here is unexpected.
+	cursor, err := filters.decodeCursor()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	// The filter conditions are the same whichever pagination style is being used.
+	where := fmt.Sprintf(`(to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') AND (genres @> $2 OR $2 = '{}')
+AND ($3 = '' OR EXISTS (%[1]s AND movie_credits.role = 'director' AND to_tsvector('simple', people.name) @@ plainto_tsquery('simple', $3)))
+AND ($4 = '' OR EXISTS (%[1]s AND movie_credits.role = 'actor' AND to_tsvector('simple', people.name) @@ plainto_tsquery('simple', $4)))
+AND ($5 = '' OR EXISTS (%[1]s AND movie_credits.role = 'writer' AND to_tsvector('simple', people.name) @@ plainto_tsquery('simple', $5)))`, creditSubquery)
+	args := []interface{}{title, pq.Array(genres), people.Director, people.Actor, people.Writer}
+
+	// Construct the SQL query to retrieve the movie records. For page-based requests we
+	// use LIMIT/OFFSET and count the total records with a window function. For cursor
+	// requests we instead seek directly to the rows after the cursor position, and ask
+	// for one extra row so that we can tell whether there is another page after this
+	// one, without having to count every matching record.
+	var query string
+	if cursor == nil {
+		query = fmt.Sprintf(`
+SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, average_rating, review_count, version
 FROM movies
-WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') AND (genres @> $2 OR $2 = '{}')
+WHERE %s
 ORDER BY %s %s, id ASC
-LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+LIMIT $6 OFFSET $7`, where, filters.sortColumn(), filters.sortDirection())
+		args = append(args, filters.limit(), filters.offset())
+	} else {
+		keyset, orderBy := filters.keysetClause(cursor, 6, 7)
+		query = fmt.Sprintf(`
+SELECT 0, id, created_at, title, year, runtime, genres, average_rating, review_count, version
+FROM movies
+WHERE %s AND %s
+ORDER BY %s
+LIMIT $8`, where, keyset, orderBy)
+		args = append(args, cursor.Value, cursor.ID, filters.limit()+1)
+	}
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// As our SQL query now has quite a few placeholder parameters, let's collect the // values for the placeholders in a slice. Notice here how we call the limit() and // offset() methods on the Filters struct to get the appropriate values for the // LIMIT and OFFSET clauses.
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
 	// And then pass the args slice to QueryContext() as a variadic parameter.
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -217,6 +262,8 @@ LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 			&movie.Year,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
+			&movie.AverageRating,
+			&movie.ReviewCount,
 			&movie.Version,
 		)
 		if err != nil {
@@ -230,8 +277,66 @@ LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 		return nil, Metadata{}, err
 	}
 
-	// Generate a Metadata struct, passing in the total record count and pagination // parameters from the client.
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	var metadata Metadata
+	var hasNext, hasPrev bool
+	if cursor == nil {
+		// Generate a Metadata struct, passing in the total record count and pagination // parameters from the client.
+		metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+		hasNext = filters.Page*filters.PageSize < totalRecords
+		hasPrev = filters.Page > 1 && len(movies) > 0
+	} else {
+		metadata = Metadata{PageSize: filters.PageSize}
+		more := len(movies) > filters.limit()
+		if more {
+			movies = movies[:filters.limit()]
+		}
+		// Rows for a backward cursor come back in reverse order, so put them back the
+		// right way round. In that case we know there is a next page (it's the one the
+		// client came from), and the extra row tells us whether there's a previous one.
+		if cursor.Backward {
+			for i, j := 0, len(movies)-1; i < j; i, j = i+1, j-1 {
+				movies[i], movies[j] = movies[j], movies[i]
+			}
+			hasNext, hasPrev = len(movies) > 0, more
+		} else {
+			hasNext, hasPrev = more, len(movies) > 0
+		}
+	}
+
+	// Add the cursors for the neighbouring pages. These are returned for page-based
+	// requests too, so that clients can switch over to cursor pagination at any point.
+	if len(filters.CursorKey) > 0 && len(movies) > 0 {
+		column := filters.sortColumn()
+		if hasNext {
+			last := movies[len(movies)-1]
+			metadata.NextCursor = filters.encodeCursor(last.sortValue(column), last.ID, false)
+		}
+		if hasPrev {
+			first := movies[0]
+			metadata.PrevCursor = filters.encodeCursor(first.sortValue(column), first.ID, true)
+		}
+	}
 	// If everything went OK, then return the slice of movies.
 	return movies, metadata, nil
 }
+
+// sortValue() returns the movie's value for one of the sortable columns, formatted as a
+// string for use in a pagination cursor.
+func (movie *Movie) sortValue(column string) string {
+	switch column {
+	case "id":
+		return strconv.FormatInt(movie.ID, 10)
+	case "title":
+		return movie.Title
+	case "year":
+		return strconv.FormatInt(int64(movie.Year), 10)
+	case "runtime":
+		return strconv.FormatInt(int64(movie.Runtime), 10)
+	case "average_rating":
+		return strconv.FormatFloat(movie.AverageRating, 'g', -1, 64)
+	case "review_count":
+		return strconv.FormatInt(int64(movie.ReviewCount), 10)
+	default:
+		panic("unsupported cursor sort column: " + column)
+	}
+}
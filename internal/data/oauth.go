@@ -0,0 +1,282 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/shakilbd009/go-greenlight-api/internal/validator"
+)
+
+// OAuthClient is a third-party application registered to request access to the API on
+// behalf of users. Confidential clients have a secret (and can use the
+// client_credentials grant, acting as the user who registered them); public clients,
+// such as mobile or single-page apps, have no secret and must use PKCE. The Scopes
+// field lists the permission codes which the client may request. ClientSecret is only
+// set when the client is created.
+type OAuthClient struct {
+	ID           int64       `json:"id"`
+	ClientID     string      `json:"client_id"`
+	ClientSecret string      `json:"client_secret,omitempty"`
+	SecretHash   []byte      `json:"-"`
+	UserID       int64       `json:"-"`
+	Name         string      `json:"name"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"`
+	Confidential bool        `json:"confidential"`
+	CreatedAt    time.Time   `json:"created_at"`
+}
+
+// ValidateOAuthClient checks the fields of a client registration. The
+// knownPermissions argument should hold every permission code which exists.
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient, knownPermissions Permissions) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(client.RedirectURIs) > 0, "redirect_uris", "must contain at least 1 URI")
+	v.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 URIs")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+	for _, uri := range client.RedirectURIs {
+		u, err := url.Parse(uri)
+		v.Check(err == nil && u.IsAbs() && u.Host != "" && u.Fragment == "", "redirect_uris", "must only contain absolute URIs without a fragment")
+	}
+	v.Check(len(client.Scopes) > 0, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+	for _, code := range client.Scopes {
+		v.Check(knownPermissions.Include(code), "scopes", "must only contain known permission codes")
+	}
+}
+
+// AllowsRedirectURI reports whether uri exactly matches one of the client's registered
+// redirect URIs.
+func (c *OAuthClient) AllowsRedirectURI(uri string) bool {
+	return validator.In(uri, c.RedirectURIs...)
+}
+
+// Define the OAuthClientModel type.
+type OAuthClientModel struct {
+	DB *sql.DB
+}
+
+// Insert() registers a client, generating its client ID and (for confidential clients)
+// its secret.
+func (m OAuthClientModel) Insert(client *OAuthClient) error {
+	clientID, err := randomString(16)
+	if err != nil {
+		return err
+	}
+	client.ClientID = clientID
+	if client.Confidential {
+		secret, err := randomString(32)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256([]byte(secret))
+		client.ClientSecret = secret
+		client.SecretHash = hash[:]
+	}
+	query := `
+INSERT INTO oauth_clients (client_id, secret_hash, user_id, name, redirect_uris, scopes)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, created_at`
+	args := []interface{}{
+		client.ClientID, client.SecretHash, client.UserID, client.Name,
+		pq.Array(client.RedirectURIs), pq.Array([]string(client.Scopes)),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.ID, &client.CreatedAt)
+}
+
+// GetByClientID() retrieves a client by its public client ID.
+func (m OAuthClientModel) GetByClientID(clientID string) (*OAuthClient, error) {
+	query := `
+SELECT id, client_id, secret_hash, user_id, name, redirect_uris, scopes, created_at
+FROM oauth_clients
+WHERE client_id = $1`
+	var client OAuthClient
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, clientID).Scan(
+		&client.ID,
+		&client.ClientID,
+		&client.SecretHash,
+		&client.UserID,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		pq.Array((*[]string)(&client.Scopes)),
+		&client.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	client.Confidential = client.SecretHash != nil
+	return &client, nil
+}
+
+// GetAllForUser() returns the clients registered by a user.
+func (m OAuthClientModel) GetAllForUser(userID int64) ([]*OAuthClient, error) {
+	query := `
+SELECT id, client_id, secret_hash, user_id, name, redirect_uris, scopes, created_at
+FROM oauth_clients
+WHERE user_id = $1
+ORDER BY id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := []*OAuthClient{}
+	for rows.Next() {
+		var client OAuthClient
+		err := rows.Scan(
+			&client.ID,
+			&client.ClientID,
+			&client.SecretHash,
+			&client.UserID,
+			&client.Name,
+			pq.Array(&client.RedirectURIs),
+			pq.Array((*[]string)(&client.Scopes)),
+			&client.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		client.Confidential = client.SecretHash != nil
+		clients = append(clients, &client)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// Delete() removes one of a user's clients. Any tokens issued to it are deleted too.
+func (m OAuthClientModel) Delete(userID, id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+DELETE FROM oauth_clients WHERE id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// SecretMatches reports whether secret is the client's secret. It always returns false
+// for public clients.
+func (c *OAuthClient) SecretMatches(secret string) bool {
+	if c.SecretHash == nil {
+		return false
+	}
+	hash := sha256.Sum256([]byte(secret))
+	return hmac.Equal(hash[:], c.SecretHash)
+}
+
+// OAuthCode is an authorization code, issued once a user has approved a client's
+// request and exchanged by the client for an access token. CodeChallenge holds the PKCE
+// S256 challenge, if one was given.
+type OAuthCode struct {
+	Plaintext   string
+	Hash        []byte
+	ClientID    int64
+	UserID      int64
+	RedirectURI string
+	// RedirectURIExplicit is true if the client included the redirect URI in the
+	// authorization request, in which case it must be sent again to redeem the code.
+	RedirectURIExplicit bool
+	Scopes              Permissions
+	CodeChallenge       string
+	Expiry              time.Time
+}
+
+// Define the OAuthCodeModel type.
+type OAuthCodeModel struct {
+	DB *sql.DB
+}
+
+// New() generates and stores an authorization code.
+func (m OAuthCodeModel) New(code *OAuthCode, ttl time.Duration) error {
+	plaintext, err := randomString(20)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(plaintext))
+	code.Plaintext = plaintext
+	code.Hash = hash[:]
+	code.Expiry = time.Now().Add(ttl)
+	query := `
+INSERT INTO oauth_codes (hash, client_id, user_id, redirect_uri, redirect_uri_explicit, scopes, code_challenge, expiry)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	args := []interface{}{
+		code.Hash, code.ClientID, code.UserID, code.RedirectURI, code.RedirectURIExplicit,
+		pq.Array([]string(code.Scopes)), code.CodeChallenge, code.Expiry,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Consume() deletes an authorization code issued to the given client and returns it.
+// Deleting the code as it is read makes sure that it can only be exchanged once.
+// ErrRecordNotFound is returned for unknown, expired or already used codes.
+func (m OAuthCodeModel) Consume(plaintext string, clientID int64) (*OAuthCode, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := `
+DELETE FROM oauth_codes
+WHERE hash = $1 AND client_id = $2
+RETURNING user_id, redirect_uri, redirect_uri_explicit, scopes, code_challenge, expiry`
+	code := OAuthCode{Hash: hash[:], ClientID: clientID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash[:], clientID).Scan(
+		&code.UserID, &code.RedirectURI, &code.RedirectURIExplicit, pq.Array((*[]string)(&code.Scopes)), &code.CodeChallenge, &code.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if !code.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	return &code, nil
+}
+
+// randomString() returns a random lowercase base32 string encoding n random bytes.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)), nil
+}
@@ -0,0 +1,285 @@
+package data
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/validator"
+)
+
+// PasswordPolicy holds the rules which new passwords must follow. They are only applied
+// when a password is set, so existing passwords keep working if the policy is
+// tightened.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters (not bytes).
+	MinLength int
+	// MinClasses is how many of the character classes (lowercase letters, uppercase
+	// letters, digits and symbols) must be used.
+	MinClasses int
+	// MinScore is the minimum strength score from PasswordStrength(), from 0 to 4.
+	MinScore int
+	// Breached, if set, lists the passwords which have appeared in data breaches.
+	Breached *BreachedPasswords
+}
+
+// The policy applied by ValidatePasswordPolicy(). The default matches the checks which
+// were made before the policy was configurable.
+var passwordPolicy = &PasswordPolicy{MinLength: 8}
+
+// SetPasswordPolicy sets the policy for new passwords. It should be called once, before
+// the models are used.
+func SetPasswordPolicy(policy *PasswordPolicy) {
+	passwordPolicy = policy
+}
+
+// ValidatePasswordPolicy checks a new password for a user against the password policy.
+// The user's name and email address are used to reject passwords which contain them.
+func ValidatePasswordPolicy(v *validator.Validator, password string, user *User) {
+	policy := passwordPolicy
+	v.Check(utf8.RuneCountInString(password) >= policy.MinLength, "password", fmt.Sprintf("must be at least %d characters long", policy.MinLength))
+	v.Check(characterClasses(password) >= policy.MinClasses, "password",
+		fmt.Sprintf("must contain at least %d of: lowercase letters, uppercase letters, digits and symbols", policy.MinClasses))
+	v.Check(!containsPersonalInfo(password, user), "password", "must not contain your name or email address")
+	v.Check(PasswordStrength(password, user.Name, user.Email) >= policy.MinScore, "password", "is too easy to guess")
+	if policy.Breached != nil {
+		v.Check(!policy.Breached.Contains(password), "password", "has appeared in a data breach and must not be used")
+	}
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	n := 0
+	for _, present := range []bool{lower, upper, digit, symbol} {
+		if present {
+			n++
+		}
+	}
+	return n
+}
+
+// containsPersonalInfo reports whether the password contains the user's email address,
+// its local part, or any part of their name which is at least 3 characters long.
+func containsPersonalInfo(password string, user *User) bool {
+	password = strings.ToLower(password)
+	for _, part := range personalTokens(user.Name, user.Email) {
+		if strings.Contains(password, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func personalTokens(name, email string) []string {
+	var tokens []string
+	email = strings.ToLower(email)
+	if email != "" {
+		tokens = append(tokens, email)
+		if at := strings.LastIndex(email, "@"); at > 0 {
+			tokens = append(tokens, email[:at])
+		}
+	}
+	for _, part := range strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		tokens = append(tokens, part)
+	}
+	long := tokens[:0]
+	for _, token := range tokens {
+		if utf8.RuneCountInString(token) >= 3 {
+			long = append(long, token)
+		}
+	}
+	return long
+}
+
+// commonPasswords are base words which appear again and again in password dumps. A
+// password built around one of them is only as strong as what's added to it.
+var commonPasswords = []string{
+	"password", "passw0rd", "qwerty", "qwertyuiop", "asdfgh", "zxcvbn", "letmein", "welcome",
+	"admin", "login", "iloveyou", "monkey", "dragon", "football", "baseball", "master",
+	"shadow", "sunshine", "princess", "superman", "batman", "trustno1", "abc123", "starwars",
+	"whatever", "freedom", "secret", "changeme", "greenlight", "movie", "movies",
+}
+
+// keyboardRows are used to spot runs of adjacent keys, such as "asdf".
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm", "abcdefghijklmnopqrstuvwxyz"}
+
+// PasswordStrength estimates how hard a password is to guess, in the style of zxcvbn:
+// it estimates the number of guesses an attacker would need, treating common words,
+// the user's own details, repeated characters and sequences as cheap to guess, and
+// returns a score from 0 (trivial) to 4 (strong).
+func PasswordStrength(password, name, email string) int {
+	lower := strings.ToLower(password)
+
+	// Remove the predictable parts of the password, each of which only adds a few
+	// guesses, and count the rest by brute force.
+	guesses := 1.0
+	for _, word := range append(personalTokens(name, email), commonPasswords...) {
+		if strings.Contains(lower, word) {
+			lower = strings.Replace(lower, word, "", 1)
+			guesses *= float64(len(commonPasswords)) * 2
+		}
+	}
+	runes := []rune(lower)
+	effective := 0.0
+	for i, r := range runes {
+		switch {
+		case i > 0 && r == runes[i-1]:
+			// Repeated characters are almost free.
+			effective += 0.1
+		case i > 0 && isSequential(runes[i-1], r):
+			effective += 0.25
+		default:
+			effective++
+		}
+	}
+	guesses *= math.Pow(float64(alphabetSize(password)), effective)
+
+	log := math.Log10(guesses)
+	switch {
+	case log < 3:
+		return 0
+	case log < 6:
+		return 1
+	case log < 8:
+		return 2
+	case log < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// isSequential reports whether b follows a in the alphabet, or on a keyboard row, in
+// either direction.
+func isSequential(a, b rune) bool {
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		j := strings.IndexRune(row, b)
+		if i >= 0 && j >= 0 && (i-j == 1 || j-i == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+// alphabetSize returns the size of the character set which the password appears to be
+// drawn from.
+func alphabetSize(password string) int {
+	size := 0
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	if size == 0 {
+		size = 1
+	}
+	return size
+}
+
+// BreachedPasswords is a set of SHA-1 hash prefixes of passwords which are known to have
+// been exposed in data breaches, such as those published by Have I Been Pwned. Storing
+// prefixes rather than full hashes keeps the list small, at the cost of occasionally
+// rejecting a password which only shares a prefix with a breached one.
+type BreachedPasswords struct {
+	prefixLength int
+	prefixes     map[string]struct{}
+}
+
+// LoadBreachedPasswords reads a file of hex-encoded SHA-1 hashes or hash prefixes, one
+// per line. Anything after a colon (such as the counts in the Have I Been Pwned
+// downloads) is ignored, as are blank lines. Every line must have the same length,
+// which must be between 5 and 40 hex characters.
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &BreachedPasswords{prefixes: make(map[string]struct{})}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		prefix := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(prefix, ':'); i >= 0 {
+			prefix = prefix[:i]
+		}
+		if prefix == "" {
+			continue
+		}
+		prefix = strings.ToUpper(prefix)
+		if _, err := hex.DecodeString(prefix + strings.Repeat("0", len(prefix)%2)); err != nil || len(prefix) < 5 || len(prefix) > 40 {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-1 prefix", path, line)
+		}
+		if b.prefixLength == 0 {
+			b.prefixLength = len(prefix)
+		} else if len(prefix) != b.prefixLength {
+			return nil, fmt.Errorf("%s:%d: all prefixes must have the same length", path, line)
+		}
+		b.prefixes[prefix] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Len returns the number of prefixes in the list.
+func (b *BreachedPasswords) Len() int {
+	return len(b.prefixes)
+}
+
+// Contains reports whether the password's SHA-1 hash starts with one of the prefixes.
+func (b *BreachedPasswords) Contains(password string) bool {
+	if b.prefixLength == 0 {
+		return false
+	}
+	sum := sha1.Sum([]byte(password))
+	_, ok := b.prefixes[strings.ToUpper(hex.EncodeToString(sum[:]))[:b.prefixLength]]
+	return ok
+}
@@ -0,0 +1,179 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/validator"
+)
+
+func TestPasswordStrength(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"aaaaaaaa", 0},
+		{"password", 0},
+		{"abcdefgh", 1},
+		{"qwerty123", 1},
+		{"Password1", 1},
+		{"alicesmith99", 1},
+		{"zq8rn", 2},
+		{"zq8rnw", 3},
+		{"xK9#mQ2$vL7!", 4},
+		{"correct horse battery staple", 4},
+	}
+	for _, tt := range tests {
+		if got := PasswordStrength(tt.password, "Alice Smith", "alice@example.com"); got != tt.want {
+			t.Errorf("PasswordStrength(%q) = %d; want %d", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestContainsPersonalInfo(t *testing.T) {
+	user := &User{Name: "Alice O'Neil-Smith", Email: "Alice.S@Example.com"}
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"alice.s@example.com!", true},
+		{"xxALICE.Syy", true},
+		{"my-aliceness", true},
+		{"neil4ever", true},
+		{"SMITHY", true},
+		// "O" is too short to count on its own.
+		{"o12345678", false},
+		{"example.com", false},
+		{"al1ce", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := containsPersonalInfo(tt.password, user); got != tt.want {
+			t.Errorf("containsPersonalInfo(%q) = %v; want %v", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestCharacterClasses(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"abc", 1},
+		{"ABC", 1},
+		{"123", 1},
+		{"!@#", 1},
+		{"abcABC", 2},
+		{"abc123!", 3},
+		{"aB3 ", 4},
+		{"éÉ٣", 3},
+	}
+	for _, tt := range tests {
+		if got := characterClasses(tt.password); got != tt.want {
+			t.Errorf("characterClasses(%q) = %d; want %d", tt.password, got, tt.want)
+		}
+	}
+}
+
+// writeBreachedPasswords writes contents to a file in a new temporary directory, which
+// is removed when the test finishes.
+func writeBreachedPasswords(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "breached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "breached.txt")
+	if err := ioutil.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadBreachedPasswordsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{"not hex", "5BAA6\nZZZZZ\n", "breached.txt:2: invalid SHA-1 prefix"},
+		{"too short", "5BAA\n", "breached.txt:1: invalid SHA-1 prefix"},
+		{"too long", strings.Repeat("A", 41) + "\n", "breached.txt:1: invalid SHA-1 prefix"},
+		{"mixed lengths", "5BAA6\n\n5BAA61\n", "breached.txt:3: all prefixes must have the same length"},
+	}
+	for _, tt := range tests {
+		_, err := LoadBreachedPasswords(writeBreachedPasswords(t, tt.contents))
+		if err == nil || !strings.HasSuffix(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v; want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if _, err := LoadBreachedPasswords(filepath.Join(os.TempDir(), "does-not-exist", "breached.txt")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+// The SHA-1 hash of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8.
+func TestBreachedPasswordsContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantLen  int
+		password string
+		want     bool
+	}{
+		{"five character prefix", "5BAA6\n", 1, "password", true},
+		{"lowercase with count", "5baa61e4:3861493\n", 1, "password", true},
+		{"full hash", "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8\n", 1, "password", true},
+		{"odd length prefix", "5BAA61E4C\n", 1, "password", true},
+		{"blank lines ignored", "\n  0000A  \n\n5BAA6\n", 2, "password", true},
+		{"different prefix", "5BAA7\n", 1, "password", false},
+		{"only matches the start", "AA61E\n", 1, "password", false},
+		{"other password", "5BAA6\n", 1, "pa55word", false},
+		{"empty file", "", 0, "password", false},
+	}
+	for _, tt := range tests {
+		b, err := LoadBreachedPasswords(writeBreachedPasswords(t, tt.contents))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if b.Len() != tt.wantLen {
+			t.Errorf("%s: Len = %d; want %d", tt.name, b.Len(), tt.wantLen)
+		}
+		if got := b.Contains(tt.password); got != tt.want {
+			t.Errorf("%s: Contains(%q) = %v; want %v", tt.name, tt.password, got, tt.want)
+		}
+	}
+}
+
+// The policy's minimum length is the only length rule for new passwords, and it counts
+// characters, not bytes.
+func TestPasswordMinLength(t *testing.T) {
+	defer SetPasswordPolicy(passwordPolicy)
+	SetPasswordPolicy(&PasswordPolicy{MinLength: 4})
+	user := &User{Name: "Alice", Email: "alice@example.com"}
+
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"zq8r", true},
+		{"zq8", false},
+		{"żółw", true},
+		{"żół", false},
+	}
+	for _, tt := range tests {
+		v := validator.New()
+		ValidatePasswordPlaintext(v, tt.password)
+		ValidatePasswordPolicy(v, tt.password, user)
+		if v.Valid() != tt.want {
+			t.Errorf("%q: valid = %v; want %v (%v)", tt.password, v.Valid(), tt.want, v.Errors)
+		}
+	}
+}
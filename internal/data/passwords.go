@@ -0,0 +1,192 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes passwords and checks plaintext passwords against stored hashes.
+// Hashes are self-describing, so each hasher can tell whether it produced a hash, and
+// whether the hash was produced with weaker parameters than it currently uses.
+type PasswordHasher interface {
+	Hash(plaintext string) ([]byte, error)
+	Matches(hash []byte, plaintext string) (bool, error)
+	// Identifies reports whether the hash uses this hasher's algorithm.
+	Identifies(hash []byte) bool
+	// NeedsRehash reports whether a hash identified by this hasher uses outdated
+	// parameters.
+	NeedsRehash(hash []byte) bool
+	// MaxLength is the longest password, in bytes, which the hasher can handle.
+	MaxLength() int
+}
+
+// The hasher used for new passwords, and the hashers which can verify existing ones.
+// Both algorithms are always available for verification, whichever is used for new
+// passwords: older accounts use bcrypt, and switching back to bcrypt mustn't lock out
+// users whose hashes have already been upgraded to argon2id. The parameters of an
+// argon2id hash are read from the hash itself, so the verifier's own don't matter.
+var (
+	passwordHasher    PasswordHasher = DefaultArgon2idHasher()
+	passwordVerifiers                = []PasswordHasher{&BcryptHasher{Cost: 12}, DefaultArgon2idHasher()}
+)
+
+// SetPasswordHasher sets the hasher used for new passwords. It should be called once,
+// before the models are used.
+func SetPasswordHasher(h PasswordHasher) {
+	passwordHasher = h
+}
+
+// hasherFor returns the hasher which can verify a hash, or nil if there isn't one.
+func hasherFor(hash []byte) PasswordHasher {
+	if passwordHasher.Identifies(hash) {
+		return passwordHasher
+	}
+	for _, h := range passwordVerifiers {
+		if h.Identifies(hash) {
+			return h
+		}
+	}
+	return nil
+}
+
+// maxPasswordLength is the maximum password length accepted for argon2id. The algorithm
+// itself has no practical limit, but there's no reason to accept arbitrarily large
+// inputs.
+const maxPasswordLength = 1024
+
+// Argon2idHasher hashes passwords with argon2id (RFC 9106), encoding the parameters
+// into the hash in the same format as the reference implementation:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+//
+// Memory is in KiB.
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idHasher returns an Argon2idHasher using the parameters recommended by
+// OWASP: 64 MiB of memory, 3 iterations and 2 lanes.
+func DefaultArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Memory: 64 * 1024, Iterations: 3, Parallelism: 2, SaltLength: 16, KeyLength: 32}
+}
+
+var argon2idPrefix = []byte("$argon2id$")
+
+func (h *Argon2idHasher) Hash(plaintext string) ([]byte, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(plaintext), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	return []byte(encoded), nil
+}
+
+func (h *Argon2idHasher) Matches(hash []byte, plaintext string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	if len(plaintext) > maxPasswordLength {
+		return false, nil
+	}
+	other := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *Argon2idHasher) Identifies(hash []byte) bool {
+	return bytes.HasPrefix(hash, argon2idPrefix)
+}
+
+func (h *Argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	return params.Memory < h.Memory || params.Iterations < h.Iterations || params.Parallelism != h.Parallelism ||
+		uint32(len(salt)) < h.SaltLength || uint32(len(key)) < h.KeyLength
+}
+
+func (h *Argon2idHasher) MaxLength() int {
+	return maxPasswordLength
+}
+
+// decodeArgon2id parses an encoded argon2id hash, returning its parameters, salt and
+// key.
+func decodeArgon2id(hash []byte) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errors.New("unsupported argon2id version")
+	}
+	var params Argon2idHasher
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return nil, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, errors.New("invalid argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, errors.New("invalid argon2id key")
+	}
+	return &params, salt, key, nil
+}
+
+// BcryptHasher hashes passwords with bcrypt. Bcrypt only uses the first 72 bytes of a
+// password, so ValidatePasswordPlaintext() rejects longer passwords when it is the
+// current hasher, and Matches() never accepts them.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) Hash(plaintext string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+}
+
+func (h *BcryptHasher) Matches(hash []byte, plaintext string) (bool, error) {
+	if len(plaintext) > h.MaxLength() {
+		return false, nil
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (h *BcryptHasher) Identifies(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2a$")) || bytes.HasPrefix(hash, []byte("$2b$")) || bytes.HasPrefix(hash, []byte("$2y$"))
+}
+
+func (h *BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost < h.Cost
+}
+
+func (h *BcryptHasher) MaxLength() int {
+	return 72
+}
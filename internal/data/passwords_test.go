@@ -0,0 +1,158 @@
+package data
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/validator"
+)
+
+// testArgon2idHasher uses small parameters, so that the tests run quickly.
+func testArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	h := testArgon2idHasher()
+	hash, err := h.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(hash, []byte("$argon2id$v=19$m=64,t=1,p=1$")) {
+		t.Errorf("unexpected encoding %q", hash)
+	}
+
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Memory != h.Memory || params.Iterations != h.Iterations || params.Parallelism != h.Parallelism {
+		t.Errorf("decoded parameters %+v; want %+v", params, h)
+	}
+	if uint32(len(salt)) != h.SaltLength || uint32(len(key)) != h.KeyLength {
+		t.Errorf("decoded salt length %d and key length %d", len(salt), len(key))
+	}
+
+	for _, tt := range []struct {
+		plaintext string
+		want      bool
+	}{
+		{"pa55word", true},
+		{"pa55worD", false},
+		{"", false},
+	} {
+		got, err := h.Matches(hash, tt.plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Matches(%q) = %v; want %v", tt.plaintext, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeArgon2idErrors(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$not*base64$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA",
+	} {
+		if _, _, _, err := decodeArgon2id([]byte(hash)); err == nil {
+			t.Errorf("decodeArgon2id(%q): expected an error", hash)
+		}
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	current := testArgon2idHasher()
+	hash, err := current.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		hasher *Argon2idHasher
+		want   bool
+	}{
+		{"same parameters", current, false},
+		{"weaker than current", &Argon2idHasher{Memory: 32, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}, false},
+		{"more memory", &Argon2idHasher{Memory: 128, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}, true},
+		{"more iterations", &Argon2idHasher{Memory: 64, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}, true},
+		{"different parallelism", &Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 2, SaltLength: 16, KeyLength: 32}, true},
+		{"longer key", &Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 64}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.hasher.NeedsRehash(hash); got != tt.want {
+			t.Errorf("%s: NeedsRehash = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+	if !current.NeedsRehash([]byte("$argon2id$garbage")) {
+		t.Error("NeedsRehash should be true for an unreadable hash")
+	}
+}
+
+// Switching the hasher back to bcrypt must not stop users whose passwords have been
+// hashed with argon2id from logging in, and the other way round.
+func TestPasswordVerifiesAfterSwitchingHasher(t *testing.T) {
+	defer SetPasswordHasher(passwordHasher)
+
+	SetPasswordHasher(testArgon2idHasher())
+	var argon password
+	if err := argon.Set("pa55word"); err != nil {
+		t.Fatal(err)
+	}
+	SetPasswordHasher(&BcryptHasher{Cost: 4})
+	var bcrypt password
+	if err := bcrypt.Set("pa55word"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hasher := range []PasswordHasher{&BcryptHasher{Cost: 4}, testArgon2idHasher()} {
+		SetPasswordHasher(hasher)
+		for _, p := range []*password{&argon, &bcrypt} {
+			ok, err := p.Matches("pa55word")
+			if err != nil || !ok {
+				t.Errorf("current hasher %T, hash %.10s: Matches = %v, %v", hasher, p.hash, ok, err)
+			}
+			if want := !hasher.Identifies(p.hash); p.NeedsRehash() != want {
+				t.Errorf("current hasher %T, hash %.10s: NeedsRehash = %v; want %v", hasher, p.hash, !want, want)
+			}
+		}
+	}
+}
+
+// A user whose argon2id password is longer than bcrypt allows must still be able to log
+// in after the hasher is switched to bcrypt, although they couldn't set it again.
+func TestLongPasswordLoginAfterSwitchingToBcrypt(t *testing.T) {
+	defer SetPasswordHasher(passwordHasher)
+
+	long := strings.Repeat("long password ", 8)
+	SetPasswordHasher(testArgon2idHasher())
+	var p password
+	if err := p.Set(long); err != nil {
+		t.Fatal(err)
+	}
+
+	SetPasswordHasher(&BcryptHasher{Cost: 4})
+	v := validator.New()
+	if ValidateLoginPassword(v, long); !v.Valid() {
+		t.Errorf("ValidateLoginPassword rejected a %d byte password: %v", len(long), v.Errors)
+	}
+	if ok, err := p.Matches(long); err != nil || !ok {
+		t.Errorf("Matches = %v, %v; want true", ok, err)
+	}
+	v = validator.New()
+	if ValidatePasswordPlaintext(v, long); v.Valid() {
+		t.Error("ValidatePasswordPlaintext should reject new passwords longer than bcrypt allows")
+	}
+	v = validator.New()
+	if ValidateLoginPassword(v, strings.Repeat("x", maxPasswordLength+1)); v.Valid() {
+		t.Error("ValidateLoginPassword should reject passwords over the overall limit")
+	}
+}
@@ -9,7 +9,7 @@ import (
 )
 
 // Define a Permissions slice, which we will use to will hold the permission codes (like
-//movies:read" and "movies:write") for a single user.
+// "movies:read" and "movies:write") for a single user.
 type Permissions []string
 
 // Add a helper method to check whether the Permissions slice contains a specific // permission code.
@@ -30,7 +30,8 @@ type PermissionModel struct {
 func (p PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 INSERT INTO users_permissions
-SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+ON CONFLICT DO NOTHING`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := p.DB.ExecContext(ctx, query, userID, pq.Array(codes))
@@ -40,24 +41,76 @@ SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
 	return nil
 }
 
+// RemoveForUser() revokes one or more permissions which were granted directly to a user.
+// Permissions which the user gets from a role are not affected.
+func (p PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+DELETE FROM users_permissions
+USING permissions
+WHERE users_permissions.permission_id = permissions.id
+AND users_permissions.user_id = $1 AND permissions.code = ANY($2)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := p.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// GetDirectForUser() returns only the permission codes granted directly to a user,
+// ignoring any which come from the user's roles.
+func (p PermissionModel) GetDirectForUser(userID int64) (Permissions, error) {
+	query := `
+SELECT permissions.code
+FROM permissions
+INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+WHERE users_permissions.user_id = $1
+ORDER BY permissions.code`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := p.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
 // The GetAllForUser() method returns all permission codes for a specific user in a
 // Permissions slice. The code in this method should feel very familiar --- it uses the
 // standard pattern that we've already seen before for retrieving multiple data rows in // an SQL query.
-
+//
+// The effective permissions are the union of the permissions granted directly to the
+// user and the permissions of every role that the user holds.
 func (p PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	query := `
 SELECT permissions.code
 FROM permissions
 INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id 
-INNER JOIN users ON users_permissions.user_id = users.id
-WHERE users.id = $1`
+WHERE users_permissions.user_id = $1
+UNION
+SELECT permissions.code
+FROM permissions
+INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+WHERE users_roles.user_id = $1`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	rows, err := p.DB.QueryContext(ctx, query, userID)
 	if err != nil {
 		return nil, err
 	}
-	var permissions Permissions
+	defer rows.Close()
+	permissions := Permissions{}
 	for rows.Next() {
 		var permission string
 		err := rows.Scan(&permission)
@@ -71,3 +124,28 @@ WHERE users.id = $1`
 	}
 	return permissions, nil
 }
+
+// The GetAll() method returns every permission code which exists.
+func (p PermissionModel) GetAll() (Permissions, error) {
+	query := `
+SELECT code FROM permissions ORDER BY code`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := p.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Define the RateLimitModel type. It stores rate limit state in the database, so that
+// several API instances can share the same limits. Each key has a theoretical arrival
+// time (TAT), as used by the generic cell rate algorithm: the time, in seconds since the
+// Unix epoch, at which the key's allowance will be completely refilled. The database
+// clock is used throughout, so that differences between the instances' clocks don't
+// matter.
+type RateLimitModel struct {
+	DB *sql.DB
+}
+
+// Take() tries to use one request from a key's allowance, where interval is the time
+// (in seconds) it takes to earn one request and limit is the maximum time the TAT may
+// be ahead of now: the burst size multiplied by the interval. It returns whether the
+// request is allowed, along with the key's TAT and the database's current time, both in
+// seconds since the Unix epoch. The TAT is only moved forward if the request is
+// allowed.
+func (m RateLimitModel) Take(key string, interval, limit float64) (bool, float64, float64, error) {
+	query := `
+WITH clock AS (
+	SELECT EXTRACT(EPOCH FROM NOW())::double precision AS now
+)
+INSERT INTO rate_limits (key, tat)
+SELECT $1, clock.now + $2::double precision FROM clock
+ON CONFLICT (key) DO UPDATE
+SET tat = GREATEST(rate_limits.tat, (SELECT now FROM clock)) + $2::double precision
+WHERE GREATEST(rate_limits.tat, (SELECT now FROM clock)) + $2::double precision - (SELECT now FROM clock) <= $3::double precision
+RETURNING tat, (SELECT now FROM clock)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var tat, now float64
+	err := m.DB.QueryRowContext(ctx, query, key, interval, limit).Scan(&tat, &now)
+	if err == nil {
+		return true, tat, now, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, 0, 0, err
+	}
+
+	// The update was skipped, so the request isn't allowed. Read the TAT to work out when
+	// the next request will be.
+	query = `
+SELECT tat, EXTRACT(EPOCH FROM NOW())::double precision FROM rate_limits WHERE key = $1`
+	err = m.DB.QueryRowContext(ctx, query, key).Scan(&tat, &now)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	return false, tat, now, nil
+}
+
+// DeleteExpired() removes the keys whose allowance has been completely refilled, as
+// they are no different from keys which have never been seen.
+func (m RateLimitModel) DeleteExpired() error {
+	query := `
+DELETE FROM rate_limits WHERE tat < EXTRACT(EPOCH FROM NOW())::double precision`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query)
+	return err
+}
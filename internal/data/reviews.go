@@ -0,0 +1,254 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shakilbd009/go-greenlight-api/internal/validator"
+)
+
+// Define a custom ErrDuplicateReview error, returned when a user tries to review a movie
+// that they have already reviewed.
+var (
+	ErrDuplicateReview = errors.New("duplicate review")
+)
+
+// Review holds a single user's rating (from 1 to 10) and optional written review for a
+// movie. Each user may only have one review per movie.
+type Review struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	MovieID   int64     `json:"movie_id"`
+	UserID    int64     `json:"user_id"`
+	Rating    int32     `json:"rating"`
+	Body      string    `json:"body,omitempty"`
+	Version   int32     `json:"version"`
+}
+
+func ValidateReview(v *validator.Validator, review *Review) {
+	v.Check(review.Rating != 0, "rating", "must be provided")
+	v.Check(review.Rating >= 1 && review.Rating <= 10, "rating", "must be between 1 and 10")
+	v.Check(len(review.Body) <= 10_000, "body", "must not be more than 10000 bytes long")
+}
+
+// Define a ReviewModel struct type which wraps a sql.DB connection pool.
+type ReviewModel struct {
+	DB *sql.DB
+}
+
+// Insert() adds a new review and refreshes the aggregated rating on the movie in the
+// same transaction. If the movie doesn't exist an ErrRecordNotFound error is returned,
+// and if the user has already reviewed it an ErrDuplicateReview error is returned.
+func (m ReviewModel) Insert(review *Review) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockMovie(ctx, tx, review.MovieID); err != nil {
+		return err
+	}
+	query := `
+INSERT INTO reviews (movie_id, user_id, rating, body)
+VALUES ($1, $2, $3, $4)
+RETURNING id, created_at, updated_at, version`
+	args := []interface{}{review.MovieID, review.UserID, review.Rating, review.Body}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&review.ID, &review.CreatedAt, &review.UpdatedAt, &review.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "reviews_movie_id_user_id_key"`:
+			return ErrDuplicateReview
+		default:
+			return err
+		}
+	}
+	if err := refreshMovieRating(ctx, tx, review.MovieID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get() retrieves a specific review for a movie.
+func (m ReviewModel) Get(movieID, id int64) (*Review, error) {
+	if movieID < 1 || id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, created_at, updated_at, movie_id, user_id, rating, body, version
+FROM reviews
+WHERE movie_id = $1 AND id = $2`
+	var review Review
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, movieID, id).Scan(
+		&review.ID,
+		&review.CreatedAt,
+		&review.UpdatedAt,
+		&review.MovieID,
+		&review.UserID,
+		&review.Rating,
+		&review.Body,
+		&review.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &review, nil
+}
+
+// Update() saves changes to a review, using the version column to detect edit
+// conflicts in the same way as MovieModel.Update(), and refreshes the aggregated
+// rating on the movie.
+func (m ReviewModel) Update(review *Review) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockMovie(ctx, tx, review.MovieID); err != nil {
+		return err
+	}
+	query := `
+UPDATE reviews
+SET rating = $1, body = $2, updated_at = NOW(), version = version + 1
+WHERE id = $3 AND movie_id = $4 AND version = $5
+RETURNING updated_at, version`
+	args := []interface{}{review.Rating, review.Body, review.ID, review.MovieID, review.Version}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&review.UpdatedAt, &review.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	if err := refreshMovieRating(ctx, tx, review.MovieID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete() removes a review and refreshes the aggregated rating on the movie.
+func (m ReviewModel) Delete(movieID, id int64) error {
+	if movieID < 1 || id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockMovie(ctx, tx, movieID); err != nil {
+		return err
+	}
+	query := `
+DELETE FROM reviews WHERE movie_id = $1 AND id = $2`
+	result, err := tx.ExecContext(ctx, query, movieID, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	if err := refreshMovieRating(ctx, tx, movieID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAll() returns a page of reviews for a movie, along with the pagination metadata.
+func (m ReviewModel) GetAll(movieID int64, filters Filters) ([]*Review, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, created_at, updated_at, movie_id, user_id, rating, body, version
+FROM reviews
+WHERE movie_id = $1
+ORDER BY %s %s, id ASC
+LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	reviews := []*Review{}
+	for rows.Next() {
+		var review Review
+		err := rows.Scan(
+			&totalRecords,
+			&review.ID,
+			&review.CreatedAt,
+			&review.UpdatedAt,
+			&review.MovieID,
+			&review.UserID,
+			&review.Rating,
+			&review.Body,
+			&review.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		reviews = append(reviews, &review)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return reviews, metadata, nil
+}
+
+// lockMovie() takes a row lock on the movie for the rest of the transaction, so that
+// concurrent review changes for the same movie recalculate its rating one at a time.
+func lockMovie(ctx context.Context, tx *sql.Tx, movieID int64) error {
+	if movieID < 1 {
+		return ErrRecordNotFound
+	}
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM movies WHERE id = $1 FOR UPDATE`, movieID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshMovieRating() recalculates the average rating and review count stored on the
+// movie from its reviews. Note that this doesn't bump the movie version, as the catalog
+// data which clients edit hasn't changed.
+func refreshMovieRating(ctx context.Context, tx *sql.Tx, movieID int64) error {
+	query := `
+UPDATE movies
+SET average_rating = COALESCE((SELECT round(avg(rating), 2) FROM reviews WHERE movie_id = $1), 0),
+    review_count = (SELECT count(*) FROM reviews WHERE movie_id = $1)
+WHERE id = $1`
+	_, err := tx.ExecContext(ctx, query, movieID)
+	return err
+}
@@ -0,0 +1,295 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/shakilbd009/go-greenlight-api/internal/validator"
+)
+
+// Define a custom ErrDuplicateRole error, returned when creating a role with a code
+// that is already in use.
+var (
+	ErrDuplicateRole = errors.New("duplicate role")
+)
+
+// Role bundles a set of permission codes under a name, so that they can be granted to
+// users together.
+type Role struct {
+	ID          int64       `json:"id"`
+	Code        string      `json:"code"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+	Version     int32       `json:"version"`
+}
+
+// ValidateRole checks the role fields. The knownPermissions argument should hold every
+// permission code which exists, so that we can reject codes that don't.
+func ValidateRole(v *validator.Validator, role *Role, knownPermissions Permissions) {
+	v.Check(role.Code != "", "code", "must be provided")
+	v.Check(len(role.Code) <= 100, "code", "must not be more than 100 bytes long")
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 500, "name", "must not be more than 500 bytes long")
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range role.Permissions {
+		v.Check(knownPermissions.Include(code), "permissions", "must only contain known permission codes")
+	}
+}
+
+// Define the RoleModel type.
+type RoleModel struct {
+	DB *sql.DB
+}
+
+// Insert() creates a new role along with its permissions.
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+INSERT INTO roles (code, name)
+VALUES ($1, $2)
+RETURNING id, version`
+	err = tx.QueryRowContext(ctx, query, role.Code, role.Name).Scan(&role.ID, &role.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_code_key"`:
+			return ErrDuplicateRole
+		default:
+			return err
+		}
+	}
+	if err := setRolePermissions(ctx, tx, role.ID, role.Permissions); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Get() retrieves a role and its permission codes.
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT roles.id, roles.code, roles.name, roles.version,
+	COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+FROM roles
+LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+LEFT JOIN permissions ON roles_permissions.permission_id = permissions.id
+WHERE roles.id = $1
+GROUP BY roles.id`
+	var role Role
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&role.ID,
+		&role.Code,
+		&role.Name,
+		&role.Version,
+		pq.Array((*[]string)(&role.Permissions)),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &role, nil
+}
+
+// GetAll() returns every role, ordered by ID.
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+SELECT roles.id, roles.code, roles.name, roles.version,
+	COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+FROM roles
+LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+LEFT JOIN permissions ON roles_permissions.permission_id = permissions.id
+GROUP BY roles.id
+ORDER BY roles.id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []*Role{}
+	for rows.Next() {
+		var role Role
+		err := rows.Scan(
+			&role.ID,
+			&role.Code,
+			&role.Name,
+			&role.Version,
+			pq.Array((*[]string)(&role.Permissions)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// Update() saves the role name and replaces its permissions, using the version column
+// to detect edit conflicts.
+func (m RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+UPDATE roles
+SET code = $1, name = $2, version = version + 1
+WHERE id = $3 AND version = $4
+RETURNING version`
+	args := []interface{}{role.Code, role.Name, role.ID, role.Version}
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&role.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_code_key"`:
+			return ErrDuplicateRole
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM roles_permissions WHERE role_id = $1`, role.ID); err != nil {
+		return err
+	}
+	if err := setRolePermissions(ctx, tx, role.ID, role.Permissions); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete() removes a role. Users who held the role lose the permissions it granted.
+func (m RoleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+DELETE FROM roles WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// AddForUser() assigns one or more roles (identified by their codes) to a user. Roles
+// which the user already holds are ignored. If any of the codes doesn't match a role,
+// ErrRecordNotFound is returned, so that a mistyped code can't silently grant nothing.
+func (m RoleModel) AddForUser(userID int64, codes ...string) error {
+	query := `
+WITH matched AS (
+	SELECT id FROM roles WHERE code = ANY($2)
+), inserted AS (
+	INSERT INTO users_roles
+	SELECT $1, id FROM matched
+	ON CONFLICT DO NOTHING
+)
+SELECT count(*) FROM matched`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var matched int
+	if err := m.DB.QueryRowContext(ctx, query, userID, pq.Array(codes)).Scan(&matched); err != nil {
+		return err
+	}
+	distinct := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		distinct[code] = true
+	}
+	if matched < len(distinct) {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// SetForUser() replaces the roles held by a user with the given role codes.
+func (m RoleModel) SetForUser(userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users_roles WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	query := `
+INSERT INTO users_roles
+SELECT $1, roles.id FROM roles WHERE roles.code = ANY($2)`
+	if _, err := tx.ExecContext(ctx, query, userID, pq.Array(codes)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAllForUser() returns the codes of every role held by a user.
+func (m RoleModel) GetAllForUser(userID int64) ([]string, error) {
+	query := `
+SELECT roles.code
+FROM roles
+INNER JOIN users_roles ON users_roles.role_id = roles.id
+WHERE users_roles.user_id = $1
+ORDER BY roles.code`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	codes := []string{}
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func setRolePermissions(ctx context.Context, tx *sql.Tx, roleID int64, codes Permissions) error {
+	query := `
+INSERT INTO roles_permissions
+SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+	_, err := tx.ExecContext(ctx, query, roleID, pq.Array([]string(codes)))
+	return err
+}
@@ -6,8 +6,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/shakilbd009/go-greenlight-api/internal/validator"
 )
 
@@ -16,8 +19,16 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeRefresh        = "refresh"
+	ScopeMFAPending     = "mfa-pending"
+	ScopeLoginLink      = "login-link"
 )
 
+// Define an ErrRefreshTokenReused error, returned by Rotate() when a refresh token which
+// has already been exchanged is presented again.
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
 // Define a Token struct to hold the data for an individual token. This includes the
 // plaintext and hashed versions of the token, associated user ID, expiry time and // scope.
 type Token struct {
@@ -26,6 +37,33 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// NewEmail holds the pending email address for email-change tokens. It is empty for
+	// tokens with any other scope.
+	NewEmail string `json:"-"`
+	// UserAgent and IP record the client which an authentication token was issued to,
+	// so that the user can tell their sessions apart.
+	UserAgent string `json:"-"`
+	IP        string `json:"-"`
+	// Family links the authentication and refresh tokens which descend from the same
+	// login. Every time a refresh token is rotated, the new tokens join its family.
+	Family string `json:"-"`
+	// OAuthClientID and Permissions are set for authentication tokens issued to OAuth
+	// clients. Such tokens can only be used for the permissions which were granted to
+	// the client; for all other tokens Permissions is nil.
+	OAuthClientID int64       `json:"-"`
+	Permissions   Permissions `json:"-"`
+}
+
+// Session describes an authentication token as it is shown to its owner. The plaintext
+// token is never included; sessions are identified by their ID instead.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current"`
 }
 
 // Define the TokenModel type.
@@ -49,11 +87,177 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewEmailChange() creates and inserts an email-change token which records the new email
+// address that the user wants to switch to.
+func (m TokenModel) NewEmailChange(userID int64, ttl time.Duration, newEmail string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+	token.NewEmail = newEmail
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewSession() creates and inserts a short-lived authentication token together with a
+// refresh token which can be exchanged for new ones. The user agent and IP address of
+// the client are recorded with both. If family is empty, a new token family is started;
+// otherwise the tokens join the given family.
+func (m TokenModel) NewSession(userID int64, accessTTL, refreshTTL time.Duration, userAgent, ip, family string) (*Token, *Token, error) {
+	if family == "" {
+		var err error
+		family, err = generateFamily()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	access, err := generateToken(userID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, token := range []*Token{access, refresh} {
+		token.UserAgent = userAgent
+		token.IP = ip
+		token.Family = family
+	}
+
+	query := `
+INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family)
+VALUES ($1, $2, $3, $4, $5, $6, $7), ($8, $9, $10, $11, $12, $13, $14)`
+	args := []interface{}{
+		access.Hash, access.UserID, access.Expiry, access.Scope, access.UserAgent, access.IP, access.Family,
+		refresh.Hash, refresh.UserID, refresh.Expiry, refresh.Scope, refresh.UserAgent, refresh.IP, refresh.Family,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := m.DB.ExecContext(ctx, query, args...); err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// NewOAuth() creates and inserts an authentication token for an OAuth client, which is
+// limited to the given permissions.
+func (m TokenModel) NewOAuth(userID, clientID int64, ttl time.Duration, permissions Permissions) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.OAuthClientID = clientID
+	token.Permissions = permissions
+	if token.Permissions == nil {
+		token.Permissions = Permissions{}
+	}
+	query := `
+INSERT INTO tokens (hash, user_id, expiry, scope, oauth_client_id, permissions)
+VALUES ($1, $2, $3, $4, $5, $6)`
+	args := []interface{}{
+		token.Hash, token.UserID, token.Expiry, token.Scope, token.OAuthClientID,
+		pq.Array([]string(token.Permissions)),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return token, err
+}
+
+// NewRefresh() creates and inserts a refresh token on its own, for when authentication
+// tokens are issued without being stored (see the jwt package). A new token family is
+// started if family is empty.
+func (m TokenModel) NewRefresh(userID int64, ttl time.Duration, userAgent, ip, family string) (*Token, error) {
+	if family == "" {
+		var err error
+		family, err = generateFamily()
+		if err != nil {
+			return nil, err
+		}
+	}
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	token.UserAgent = userAgent
+	token.IP = ip
+	token.Family = family
+	err = m.Insert(token)
+	return token, err
+}
+
+// Rotate() marks a refresh token as used and returns its details, so that the caller
+// can issue replacement tokens in the same family. Refresh tokens can only be used
+// once: if a token which has already been rotated is presented again, it has most
+// likely been stolen, so the whole family is revoked and ErrRefreshTokenReused is
+// returned along with the token (so that the caller knows which family was revoked).
+// ErrRecordNotFound is returned for unknown or expired tokens.
+func (m TokenModel) Rotate(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the token row, so that two concurrent requests with the same refresh token
+	// can't both succeed.
+	query := `
+SELECT user_id, expiry, user_agent, ip, family, used_at IS NOT NULL
+FROM tokens
+WHERE hash = $1 AND scope = $2
+FOR UPDATE`
+	token := Token{Hash: tokenHash[:], Scope: ScopeRefresh}
+	var used bool
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(
+		&token.UserID, &token.Expiry, &token.UserAgent, &token.IP, &token.Family, &used,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	if used {
+		query = `
+DELETE FROM tokens
+WHERE family = $1 AND scope IN ($2, $3)`
+		_, err := tx.ExecContext(ctx, query, token.Family, ScopeAuthentication, ScopeRefresh)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return &token, ErrRefreshTokenReused
+	}
+	if !token.Expiry.After(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	// Keep the used token until it expires rather than deleting it, so that we can
+	// recognize it if it is replayed.
+	query = `
+UPDATE tokens SET used_at = NOW() WHERE hash = $1`
+	if _, err := tx.ExecContext(ctx, query, tokenHash[:]); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
 // Insert() adds the data for a specific token to the tokens table.
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-INSERT INTO tokens (hash, user_id, expiry, scope) VALUES ($1, $2, $3, $4)`
-	arg := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+INSERT INTO tokens (hash, user_id, expiry, scope, new_email, user_agent, ip, family)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	arg := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.NewEmail, token.UserAgent, token.IP, token.Family}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, arg...)
@@ -74,6 +278,186 @@ WHERE scope = $1 AND user_id = $2`
 	return err
 }
 
+// RevokeSession() logs out the session which an authentication token belongs to. The
+// token is deleted along with the rest of its family, so that the refresh token which
+// came with it can't be used to start the session again.
+func (m TokenModel) RevokeSession(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+WITH target AS (
+	SELECT hash, family FROM tokens WHERE hash = $1 AND scope = $2
+)
+DELETE FROM tokens
+WHERE hash IN (SELECT hash FROM target)
+OR (family <> '' AND family IN (SELECT family FROM target))`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], ScopeAuthentication)
+	return err
+}
+
+// DeleteOtherSessions() logs a user out of every session except the current one, which
+// is identified by currentPlaintext or currentFamily in the same way as for
+// GetAllSessionsForUser(). All of the user's other authentication and refresh tokens
+// are deleted, and the distinct families which they belonged to are returned. Tokens
+// issued to OAuth clients aren't sessions, so they are left alone: the user granted
+// those clients access separately, and their tokens expire after a short time anyway.
+func (m TokenModel) DeleteOtherSessions(userID int64, currentPlaintext, currentFamily string) ([]string, error) {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+	query := `
+WITH current_family AS (
+	SELECT family FROM tokens WHERE hash = $2 AND family <> ''
+	UNION
+	SELECT $3::text WHERE $3::text <> ''
+)
+DELETE FROM tokens
+WHERE user_id = $1 AND scope IN ($4, $5) AND hash <> $2 AND oauth_client_id IS NULL
+AND family NOT IN (SELECT family FROM current_family)
+RETURNING family`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, currentHash[:], currentFamily, ScopeAuthentication, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	families := []string{}
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var family string
+		if err := rows.Scan(&family); err != nil {
+			return nil, err
+		}
+		if family != "" && !seen[family] {
+			seen[family] = true
+			families = append(families, family)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+// DeleteForPlaintext() deletes a single token with the given scope, identified by its
+// plaintext value.
+func (m TokenModel) DeleteForPlaintext(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+DELETE FROM tokens
+WHERE scope = $1 AND hash = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
+
+// RevokeFamily() deletes every authentication and refresh token in a token family.
+func (m TokenModel) RevokeFamily(family string) error {
+	if family == "" {
+		return nil
+	}
+	query := `
+DELETE FROM tokens
+WHERE family = $1 AND scope IN ($2, $3)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, family, ScopeAuthentication, ScopeRefresh)
+	return err
+}
+
+// Touch() records that an authentication token has just been used. To avoid writing to
+// the tokens table on every request, last_used_at is only updated once it is more than
+// a minute old.
+func (m TokenModel) Touch(tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+UPDATE tokens
+SET last_used_at = NOW()
+WHERE hash = $1 AND scope = $2
+AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, tokenHash[:], ScopeAuthentication)
+	return err
+}
+
+// GetAllSessionsForUser() returns a user's unexpired tokens with the given scope (which
+// should be ScopeAuthentication, or ScopeRefresh when authentication tokens aren't
+// stored), most recently created first. Rotated refresh tokens, and tokens issued to
+// OAuth clients, are left out. The session for currentPlaintext, or in currentFamily,
+// is flagged as the current one.
+func (m TokenModel) GetAllSessionsForUser(userID int64, scope, currentPlaintext, currentFamily string) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+	query := `
+SELECT id, created_at, last_used_at, expiry, user_agent, ip,
+	hash = $3 OR (family <> '' AND family = $4)
+FROM tokens
+WHERE user_id = $1 AND scope = $2 AND expiry > NOW() AND used_at IS NULL
+AND oauth_client_id IS NULL
+ORDER BY created_at DESC, id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, scope, currentHash[:], currentFamily)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteSession() revokes one of a user's sessions by the ID of its token (which must
+// have the given scope), along with the rest of its family. It returns the family which
+// was revoked, or ErrRecordNotFound if the user has no such session.
+func (m TokenModel) DeleteSession(userID, id int64, scope string) (string, error) {
+	if id < 1 {
+		return "", ErrRecordNotFound
+	}
+	query := `
+WITH target AS (
+	SELECT id, family FROM tokens
+	WHERE id = $1 AND user_id = $2 AND scope = $3 AND oauth_client_id IS NULL
+), deleted AS (
+	DELETE FROM tokens
+	WHERE id IN (SELECT id FROM target)
+	OR (family <> '' AND family IN (SELECT family FROM target))
+)
+SELECT family FROM target`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var family string
+	err := m.DB.QueryRowContext(ctx, query, id, userID, scope).Scan(&family)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return family, nil
+}
+
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) { // Create a Token instance containing the user ID, expiry, and scope information. // Notice that we add the provided ttl (time-to-live) duration parameter to the // current time to get the expiry time?
 	token := &Token{UserID: userID,
 		Expiry: time.Now().Add(ttl),
@@ -104,3 +488,12 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	token.Hash = hash[:]
 	return token, nil
 }
+
+// generateFamily() returns a random identifier for a new token family.
+func generateFamily() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -5,10 +5,12 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/shakilbd009/go-greenlight-api/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // Define a custom ErrDuplicateEmail error.
@@ -28,13 +30,13 @@ var Anonymous = &User{}
 // any output when we encode it to JSON. Also notice that the Password field uses the
 // custom password type defined below.
 type User struct {
-	ID        int64
-	CreatedAt time.Time
-	Name      string
-	Email     string
-	Password  password
-	Activated bool
-	Version   int
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Password  password  `json:"-"`
+	Activated bool      `json:"activated"`
+	Version   int       `json:"-"`
 }
 
 func (u *User) IsAnonymous() bool {
@@ -50,8 +52,10 @@ type password struct {
 	hash      []byte
 }
 
+// The Set() method hashes a plaintext password with the current PasswordHasher (see
+// SetPasswordHasher()).
 func (p *password) Set(plaintext string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), 12)
+	hash, err := passwordHasher.Hash(plaintext)
 	if err != nil {
 		return err
 	}
@@ -63,17 +67,18 @@ func (p *password) Set(plaintext string) error {
 // The Matches() method checks whether the provided plaintext password matches the
 // hashed password stored in the struct, returning true if it matches and false // otherwise.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+	hasher := hasherFor(p.hash)
+	if hasher == nil {
+		return false, errors.New("unrecognised password hash format")
 	}
-	return true, nil
+	return hasher.Matches(p.hash, plaintextPassword)
+}
+
+// The NeedsRehash() method reports whether the stored hash was made with a different
+// algorithm to the current PasswordHasher, or with weaker parameters. Once the user's
+// plaintext password is known (when they log in), it should be hashed again.
+func (p *password) NeedsRehash() bool {
+	return !passwordHasher.Identifies(p.hash) || passwordHasher.NeedsRehash(p.hash)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -81,10 +86,20 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
+// ValidatePasswordPlaintext checks a new password against the limits of the current
+// PasswordHasher. Its minimum length is set by the password policy (see
+// ValidatePasswordPolicy()), which counts characters rather than bytes.
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= passwordHasher.MaxLength(), "password", fmt.Sprintf("must not be more than %d bytes long", passwordHasher.MaxLength()))
+}
+
+// ValidateLoginPassword checks a password which is being used to log in. The existing
+// hash may have been made by a different hasher to the current one, with a higher
+// length limit, so only the overall limit is applied here.
+func ValidateLoginPassword(v *validator.Validator, password string) {
+	v.Check(password != "", "password", "must be provided")
+	v.Check(len(password) <= maxPasswordLength, "password", fmt.Sprintf("must not be more than %d bytes long", maxPasswordLength))
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -93,8 +108,10 @@ func ValidateUser(v *validator.Validator, user *User) {
 	// Call the standalone ValidateEmail() helper.
 	ValidateEmail(v, user.Email)
 	// If the plaintext password is not nil, call the standalone // ValidatePasswordPlaintext() helper.
+	// As the password is being set, it must also follow the password policy.
 	if user.Password.plaintext != nil {
 		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidatePasswordPolicy(v, *user.Password.plaintext, user)
 	}
 	// If the password hash is ever nil, this will be due to a logic error in our
 	// codebase (probably because we forgot to set a password for the user). It's a // useful sanity check to include here, but it's not a problem with the data
@@ -139,6 +156,85 @@ AND tokens.expiry > $3`
 	return &user, nil
 }
 
+// RehashPassword() hashes a user's (correct) plaintext password again with the current
+// PasswordHasher and stores the new hash. It doesn't change the record version, as the
+// password itself is the same, and it does nothing if the password has been changed
+// since the user was read.
+func (m UserModel) RehashPassword(user *User, plaintext string) error {
+	oldHash := user.Password.hash
+	if err := user.Password.Set(plaintext); err != nil {
+		return err
+	}
+	query := `
+UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash = $3`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, user.Password.hash, user.ID, oldHash)
+	return err
+}
+
+// GetForAuthenticationToken() works like GetForToken() for authentication tokens, but
+// also returns the permissions which the token is limited to. This is nil for ordinary
+// tokens, which can use all of the user's permissions.
+func (m UserModel) GetForAuthenticationToken(tokenPlaintext string) (*User, Permissions, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, tokens.permissions FROM users
+INNER JOIN tokens
+ON users.id = tokens.user_id
+WHERE tokens.hash = $1
+AND tokens.scope = $2
+AND tokens.expiry > $3`
+	args := []interface{}{tokenHash[:], ScopeAuthentication, time.Now()}
+	var user User
+	var permissions Permissions
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version,
+		pq.Array((*[]string)(&permissions)),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	return &user, permissions, nil
+}
+
+// GetForEmailChangeToken() works like GetForToken() for email-change tokens, but also
+// returns the new email address which was recorded with the token.
+func (m UserModel) GetForEmailChangeToken(tokenPlaintext string) (*User, string, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, tokens.new_email FROM users
+INNER JOIN tokens
+ON users.id = tokens.user_id
+WHERE tokens.hash = $1
+AND tokens.scope = $2
+AND tokens.expiry > $3`
+	args := []interface{}{tokenHash[:], ScopeEmailChange, time.Now()}
+	var user User
+	var newEmail string
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version, &newEmail,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, "", ErrRecordNotFound
+		default:
+			return nil, "", err
+		}
+	}
+	return &user, newEmail, nil
+}
+
 // Insert a new record in the database for the user. Note that the id, created_at and // version fields are all automatically generated by our database, so we use the
 // RETURNING clause to read them into the User struct after the insert, in the same way // that we did when creating a movie.
 func (m UserModel) Insert(user *User) error {
@@ -162,6 +258,31 @@ RETURNING id, created_at, version`
 	return nil
 }
 
+// Retrieve the User details from the database based on the user's ID.
+func (m UserModel) Get(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+	SELECT id, created_at, name, email, password_hash, activated, version FROM users
+	WHERE id = $1`
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&user.ID,
+		&user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
@@ -212,3 +333,108 @@ func (m UserModel) Update(user *User) error {
 	}
 	return nil
 }
+
+// Delete() removes a user. Their tokens, permissions and other data are removed along
+// with them by the ON DELETE CASCADE constraints. As that includes their reviews, the
+// movies which they reviewed are locked first and have their ratings refreshed in the
+// same transaction.
+func (m UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the movies in ID order, so that this can't deadlock with another transaction
+	// doing the same.
+	query := `
+	SELECT id FROM movies
+	WHERE id IN (SELECT movie_id FROM reviews WHERE user_id = $1)
+	ORDER BY id
+	FOR UPDATE`
+	rows, err := tx.QueryContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	var movieIDs []int64
+	for rows.Next() {
+		var movieID int64
+		if err := rows.Scan(&movieID); err != nil {
+			rows.Close()
+			return err
+		}
+		movieIDs = append(movieIDs, movieID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	query = `
+	DELETE FROM users WHERE id = $1`
+	result, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	for _, movieID := range movieIDs {
+		if err := refreshMovieRating(ctx, tx, movieID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// likeEscaper escapes the characters which have a special meaning in LIKE patterns, so
+// that user input is matched literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// GetAll() returns a page of users. The name and email filters are case-insensitive
+// substring matches, and if activated is not nil only users with a matching activation
+// state are returned.
+func (m UserModel) GetAll(name, email string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, version
+	FROM users
+	WHERE (name ILIKE '%%' || $1 || '%%' OR $1 = '')
+	AND (email::text ILIKE '%%' || $2 || '%%' OR $2 = '')
+	AND ($3::boolean IS NULL OR activated = $3)
+	ORDER BY %s %s, id ASC
+	LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	args := []interface{}{likeEscaper.Replace(name), likeEscaper.Replace(email), activated, filters.limit(), filters.offset()}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(&totalRecords, &user.ID,
+			&user.CreatedAt, &user.Name, &user.Email, &user.Password.hash, &user.Activated, &user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return users, metadata, nil
+}
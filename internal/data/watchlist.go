@@ -0,0 +1,221 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Define a custom ErrDuplicateWatchlistItem error, returned when a user tries to add a
+// movie which is already on their watchlist.
+var (
+	ErrDuplicateWatchlistItem = errors.New("duplicate watchlist item")
+)
+
+// WatchlistItem represents a movie on a user's watchlist. The WatchedAt field is nil
+// until the user marks the movie as watched.
+type WatchlistItem struct {
+	UserID    int64      `json:"-"`
+	Movie     *Movie     `json:"movie"`
+	AddedAt   time.Time  `json:"added_at"`
+	Watched   bool       `json:"watched"`
+	WatchedAt *time.Time `json:"watched_at,omitempty"`
+}
+
+// Define the WatchlistModel type.
+type WatchlistModel struct {
+	DB *sql.DB
+}
+
+// Add() puts the movie in item.Movie on the user's watchlist. An ErrRecordNotFound error
+// is returned if the movie doesn't exist, and an ErrDuplicateWatchlistItem error if it
+// is already on the watchlist.
+func (m WatchlistModel) Add(item *WatchlistItem) error {
+	query := `
+INSERT INTO watchlist_items (user_id, movie_id)
+SELECT $1, id FROM movies WHERE id = $2
+RETURNING added_at`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, item.UserID, item.Movie.ID).Scan(&item.AddedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		case err.Error() == `pq: duplicate key value violates unique constraint "watchlist_items_pkey"`:
+			return ErrDuplicateWatchlistItem
+		default:
+			return err
+		}
+	}
+	item.Watched = false
+	item.WatchedAt = nil
+	return nil
+}
+
+// Remove() takes a movie off the user's watchlist.
+func (m WatchlistModel) Remove(userID, movieID int64) error {
+	if movieID < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+DELETE FROM watchlist_items WHERE user_id = $1 AND movie_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, movieID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// SetWatched() marks a watchlist item as watched (recording the current time) or as
+// unwatched (clearing it), and returns the updated item.
+func (m WatchlistModel) SetWatched(userID, movieID int64, watched bool) (*WatchlistItem, error) {
+	if movieID < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+UPDATE watchlist_items
+SET watched_at = CASE WHEN $3 THEN COALESCE(watched_at, NOW()) ELSE NULL END
+WHERE user_id = $1 AND movie_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, movieID, watched)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return m.Get(userID, movieID)
+}
+
+// Get() retrieves a single item from the user's watchlist, along with the movie.
+func (m WatchlistModel) Get(userID, movieID int64) (*WatchlistItem, error) {
+	query := `
+SELECT watchlist_items.added_at, watchlist_items.watched_at,
+	movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+	movies.average_rating, movies.review_count, movies.version
+FROM watchlist_items
+INNER JOIN movies ON watchlist_items.movie_id = movies.id
+WHERE watchlist_items.user_id = $1 AND watchlist_items.movie_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	item, err := scanWatchlistItem(m.DB.QueryRowContext(ctx, query, userID, movieID))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	item.UserID = userID
+	return item, nil
+}
+
+// GetAll() returns a page of the user's watchlist. If watched is not nil, only items
+// with the matching watched state are returned.
+func (m WatchlistModel) GetAll(userID int64, watched *bool, filters Filters) ([]*WatchlistItem, Metadata, error) {
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), watchlist_items.added_at, watchlist_items.watched_at,
+	movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres,
+	movies.average_rating, movies.review_count, movies.version
+FROM watchlist_items
+INNER JOIN movies ON watchlist_items.movie_id = movies.id
+WHERE watchlist_items.user_id = $1
+AND ($2::boolean IS NULL OR (watchlist_items.watched_at IS NOT NULL) = $2)
+ORDER BY %s %s, movies.id ASC
+LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	args := []interface{}{userID, watched, filters.limit(), filters.offset()}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	items := []*WatchlistItem{}
+	for rows.Next() {
+		var item WatchlistItem
+		var movie Movie
+		var watchedAt sql.NullTime
+		err := rows.Scan(
+			&totalRecords,
+			&item.AddedAt,
+			&watchedAt,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.AverageRating,
+			&movie.ReviewCount,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		item.UserID = userID
+		item.Movie = &movie
+		item.setWatchedAt(watchedAt)
+		items = append(items, &item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return items, metadata, nil
+}
+
+func scanWatchlistItem(row *sql.Row) (*WatchlistItem, error) {
+	var item WatchlistItem
+	var movie Movie
+	var watchedAt sql.NullTime
+	err := row.Scan(
+		&item.AddedAt,
+		&watchedAt,
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.AverageRating,
+		&movie.ReviewCount,
+		&movie.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	item.Movie = &movie
+	item.setWatchedAt(watchedAt)
+	return &item, nil
+}
+
+func (i *WatchlistItem) setWatchedAt(watchedAt sql.NullTime) {
+	i.Watched = watchedAt.Valid
+	i.WatchedAt = nil
+	if watchedAt.Valid {
+		t := watchedAt.Time
+		i.WatchedAt = &t
+	}
+}
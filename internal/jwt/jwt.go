@@ -0,0 +1,231 @@
+// Package jwt implements the small subset of JSON Web Tokens (RFC 7519) which the API
+// needs: compact-serialized tokens signed with HS256 or EdDSA (Ed25519), with the
+// signing key identified by a "kid" header so that keys can be rotated.
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Define the supported signing algorithms, using their JWA names.
+const (
+	AlgHS256 = "HS256"
+	AlgEdDSA = "EdDSA"
+)
+
+var (
+	// ErrInvalidToken is returned for tokens which are malformed, were signed with an
+	// unknown key or algorithm, or have a bad signature.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrExpiredToken is returned for correctly signed tokens which have expired.
+	ErrExpiredToken = errors.New("expired token")
+)
+
+// Claims holds the registered claims which we use, along with our own claims for the
+// user's activation state, permission codes, whether they have two-factor
+// authentication enabled, and the token family (see data.Token.Family) which the token
+// was issued to.
+type Claims struct {
+	Subject     string   `json:"sub"`
+	ID          string   `json:"jti"`
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+	Activated   bool     `json:"act"`
+	Permissions []string `json:"perms"`
+	Family      string   `json:"fam,omitempty"`
+	MFA         bool     `json:"mfa,omitempty"`
+}
+
+// Expiry returns the expiry time of the token as a time.Time.
+func (c *Claims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type key struct {
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// KeySet holds the keys for a single algorithm. New tokens are always signed with the
+// first key, but tokens signed with any of the keys are accepted, so that a new key can
+// be introduced (and an old one retired) without invalidating tokens in flight.
+type KeySet struct {
+	alg     string
+	signing string
+	keys    map[string]*key
+}
+
+// ParseKeys creates a KeySet from a space-separated list of "kid:key" pairs, where each
+// key is base64 (standard or URL-safe, padding optional) encoded. For HS256 the key is
+// the HMAC secret, which must be at least 32 bytes long. For EdDSA the key is a 32-byte
+// Ed25519 seed.
+func ParseKeys(alg, spec string) (*KeySet, error) {
+	if alg != AlgHS256 && alg != AlgEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	ks := &KeySet{alg: alg, keys: make(map[string]*key)}
+	for _, field := range strings.Fields(spec) {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("key %q is not in the format kid:key", field)
+		}
+		kid := parts[0]
+		if _, exists := ks.keys[kid]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", kid)
+		}
+		raw, err := decodeKey(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kid, err)
+		}
+		k, err := newKey(alg, raw)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kid, err)
+		}
+		ks.keys[kid] = k
+		if ks.signing == "" {
+			ks.signing = kid
+		}
+	}
+	if ks.signing == "" {
+		return nil, errors.New("no signing keys provided")
+	}
+	return ks, nil
+}
+
+// NewRandomKeys creates a KeySet containing a single random key. Tokens signed with it
+// stop being accepted when the process exits.
+func NewRandomKeys(alg string) (*KeySet, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	return ParseKeys(alg, "random:"+base64.RawURLEncoding.EncodeToString(raw))
+}
+
+func newKey(alg string, raw []byte) (*key, error) {
+	switch alg {
+	case AlgHS256:
+		if len(raw) < 32 {
+			return nil, errors.New("HS256 keys must be at least 32 bytes long")
+		}
+		return &key{secret: raw}, nil
+	default:
+		if len(raw) != ed25519.SeedSize {
+			return nil, fmt.Errorf("EdDSA keys must be a %d-byte seed", ed25519.SeedSize)
+		}
+		private := ed25519.NewKeyFromSeed(raw)
+		return &key{private: private, public: private.Public().(ed25519.PublicKey)}, nil
+	}
+}
+
+func decodeKey(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if b, err := base64.RawStdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("must be base64 encoded")
+	}
+	return b, nil
+}
+
+// Sign serializes the claims and signs them with the current signing key. If the claims
+// don't have an ID, a random one is generated.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	if claims.ID == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		claims.ID = hex.EncodeToString(b)
+	}
+	h, err := json.Marshal(header{Alg: ks.alg, Typ: "JWT", Kid: ks.signing})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ks.sign(ks.keys[ks.signing], []byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the token's signature and expiry and returns its claims. Tokens whose
+// header names a different algorithm to the key set are rejected, rather than trusting
+// the algorithm which the token claims to use.
+func (ks *KeySet) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	if err := json.Unmarshal(rawHeader, &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+	k, ok := ks.keys[h.Kid]
+	if !ok || h.Alg != ks.alg {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !ks.verify(k, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.ExpiresAt == 0 || claims.ID == "" {
+		return nil, ErrInvalidToken
+	}
+	if !now.Before(claims.Expiry()) {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+func (ks *KeySet) sign(k *key, data []byte) []byte {
+	if ks.alg == AlgHS256 {
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(k.private, data)
+}
+
+func (ks *KeySet) verify(k *key, data, signature []byte) bool {
+	if ks.alg == AlgHS256 {
+		return hmac.Equal(signature, ks.sign(k, data))
+	}
+	return ed25519.Verify(k.public, data, signature)
+}
@@ -0,0 +1,196 @@
+package jwt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	hsKey1 = base64.RawURLEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	hsKey2 = base64.RawURLEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+	edSeed = base64.RawURLEncoding.EncodeToString([]byte("ed25519 seed of exactly 32 bytes"))
+)
+
+func mustParseKeys(t *testing.T, alg, spec string) *KeySet {
+	t.Helper()
+	ks, err := ParseKeys(alg, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func testClaims(now time.Time) Claims {
+	return Claims{Subject: "42", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(), Activated: true, Family: "fam"}
+}
+
+// encodeSegment returns the base64url encoding of v marshalled as JSON.
+func encodeSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, tt := range []struct {
+		alg  string
+		spec string
+	}{
+		{AlgHS256, "k1:" + hsKey1},
+		{AlgEdDSA, "k1:" + edSeed},
+	} {
+		ks := mustParseKeys(t, tt.alg, tt.spec)
+		token, err := ks.Sign(testClaims(now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := ks.Verify(token, now)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.alg, err)
+		}
+		if claims.Subject != "42" || claims.Family != "fam" || !claims.Activated || claims.ID == "" {
+			t.Errorf("%s: unexpected claims %+v", tt.alg, claims)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ks := mustParseKeys(t, AlgHS256, "k1:"+hsKey1)
+	token, err := ks.Sign(testClaims(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+
+	tampered := testClaims(now)
+	tampered.Subject = "1"
+	tampered.ID = "x"
+	flipped := []byte(parts[2])
+	if flipped[0] == 'A' {
+		flipped[0] = 'B'
+	} else {
+		flipped[0] = 'A'
+	}
+	otherKey := mustParseKeys(t, AlgHS256, "k1:"+hsKey2)
+	otherToken, err := otherKey.Sign(testClaims(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKeys := mustParseKeys(t, AlgEdDSA, "k1:"+edSeed)
+	edToken, err := edKeys.Sign(testClaims(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		want  error
+	}{
+		{"tampered payload", parts[0] + "." + encodeSegment(t, tampered) + "." + parts[2], now, ErrInvalidToken},
+		{"tampered signature", parts[0] + "." + parts[1] + "." + string(flipped), now, ErrInvalidToken},
+		{"missing signature", parts[0] + "." + parts[1] + ".", now, ErrInvalidToken},
+		{"signed with another key", otherToken, now, ErrInvalidToken},
+		{"alg mismatch", edToken, now, ErrInvalidToken},
+		{"alg none", encodeSegment(t, header{Alg: "none", Typ: "JWT", Kid: "k1"}) + "." + parts[1] + ".", now, ErrInvalidToken},
+		{"alg none with signature", encodeSegment(t, header{Alg: "none", Typ: "JWT", Kid: "k1"}) + "." + parts[1] + "." + parts[2], now, ErrInvalidToken},
+		{"unknown kid", encodeSegment(t, header{Alg: AlgHS256, Typ: "JWT", Kid: "k9"}) + "." + parts[1] + "." + parts[2], now, ErrInvalidToken},
+		{"too few segments", parts[0] + "." + parts[1], now, ErrInvalidToken},
+		{"not base64", "!!!." + parts[1] + "." + parts[2], now, ErrInvalidToken},
+		{"expired", token, now.Add(time.Minute), ErrExpiredToken},
+		{"long expired", token, now.Add(time.Hour), ErrExpiredToken},
+	}
+	for _, tt := range tests {
+		if _, err := ks.Verify(tt.token, tt.now); err != tt.want {
+			t.Errorf("%s: got error %v; want %v", tt.name, err, tt.want)
+		}
+	}
+
+	if _, err := ks.Verify(token, now.Add(time.Minute-time.Second)); err != nil {
+		t.Errorf("token should be valid until it expires: %v", err)
+	}
+}
+
+func TestVerifyRequiresExpiryAndID(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	ks := mustParseKeys(t, AlgHS256, "k1:"+hsKey1)
+	h := encodeSegment(t, header{Alg: AlgHS256, Typ: "JWT", Kid: "k1"})
+	for _, claims := range []Claims{
+		{Subject: "42", ID: "id"},
+		{Subject: "42", ExpiresAt: now.Add(time.Minute).Unix()},
+	} {
+		signed := h + "." + encodeSegment(t, claims)
+		token := signed + "." + base64.RawURLEncoding.EncodeToString(ks.sign(ks.keys["k1"], []byte(signed)))
+		if _, err := ks.Verify(token, now); err != ErrInvalidToken {
+			t.Errorf("claims %+v: got error %v; want %v", claims, err, ErrInvalidToken)
+		}
+	}
+}
+
+// After a key rotation, new tokens are signed with the new key but tokens signed with
+// the old one are still accepted until the old key is removed.
+func TestKeyRotation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	before := mustParseKeys(t, AlgHS256, "old:"+hsKey1)
+	during := mustParseKeys(t, AlgHS256, "new:"+hsKey2+" old:"+hsKey1)
+	after := mustParseKeys(t, AlgHS256, "new:"+hsKey2)
+
+	oldToken, err := before.Sign(testClaims(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newToken, err := during.Sign(testClaims(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		ks    *KeySet
+		token string
+		ok    bool
+	}{
+		{"old token during rotation", during, oldToken, true},
+		{"new token during rotation", during, newToken, true},
+		{"new token after rotation", after, newToken, true},
+		{"old token after rotation", after, oldToken, false},
+		{"new token before rotation", before, newToken, false},
+	}
+	for _, tt := range tests {
+		_, err := tt.ks.Verify(tt.token, now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
+
+func TestParseKeysErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		alg  string
+		spec string
+	}{
+		{"unsupported algorithm", "none", "k1:" + hsKey1},
+		{"no keys", AlgHS256, ""},
+		{"missing kid", AlgHS256, ":" + hsKey1},
+		{"missing separator", AlgHS256, hsKey1},
+		{"duplicate kid", AlgHS256, "k1:" + hsKey1 + " k1:" + hsKey2},
+		{"not base64", AlgHS256, "k1:!!!"},
+		{"short HS256 key", AlgHS256, "k1:" + base64.RawURLEncoding.EncodeToString([]byte("short"))},
+		{"wrong EdDSA seed size", AlgEdDSA, "k1:" + hsKey1[:20]},
+	}
+	for _, tt := range tests {
+		if _, err := ParseKeys(tt.alg, tt.spec); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package jwt
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationList is an in-memory record of revoked token IDs (or token families). As
+// signed tokens are accepted without a database lookup, this is how a token can be
+// rejected before it expires, for example after the user logs out. Entries only need to
+// be kept until the tokens they cover have expired, after which they are dropped.
+//
+// The list is local to the process, so when running several instances a revoked token
+// is only rejected by the instance which revoked it. Keep the token lifetime short to
+// limit the impact of this.
+type RevocationList struct {
+	mu      sync.Mutex
+	entries map[string]revocation
+}
+
+// revocation records when an ID was last revoked, and how long it stays on the list.
+type revocation struct {
+	at     time.Time
+	expiry time.Time
+}
+
+// NewRevocationList returns an empty RevocationList.
+func NewRevocationList() *RevocationList {
+	return &RevocationList{entries: make(map[string]revocation)}
+}
+
+// Revoke adds an ID to the list until the given time. Revoking an ID which is already on
+// the list moves its revocation time forward, and never shortens its expiry. Expired
+// entries are pruned at the same time.
+func (l *RevocationList) Revoke(id string, until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, entry := range l.entries {
+		if !now.Before(entry.expiry) {
+			delete(l.entries, k)
+		}
+	}
+	entry := revocation{at: now, expiry: until}
+	if existing, ok := l.entries[id]; ok && existing.expiry.After(until) {
+		entry.expiry = existing.expiry
+	}
+	l.entries[id] = entry
+}
+
+// Revoked reports whether an ID is on the list.
+func (l *RevocationList) Revoked(id string) bool {
+	_, ok := l.RevokedAt(id)
+	return ok
+}
+
+// RevokedAt returns the time at which an ID was last revoked, and whether it is on the
+// list. This lets IDs which cover many tokens, such as a user's, reject only the tokens
+// which were issued before the revocation.
+func (l *RevocationList) RevokedAt(id string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[id]
+	if !ok || !time.Now().Before(entry.expiry) {
+		return time.Time{}, false
+	}
+	return entry.at, true
+}
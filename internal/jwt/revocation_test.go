@@ -0,0 +1,66 @@
+package jwt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevocationList(t *testing.T) {
+	l := NewRevocationList()
+	now := time.Now()
+
+	l.Revoke("token-id", now.Add(time.Hour))
+	l.Revoke("family", now.Add(time.Hour))
+	l.Revoke("expired", now.Add(-time.Second))
+
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"token-id", true},
+		{"family", true},
+		{"expired", false},
+		{"unknown", false},
+	}
+	for _, tt := range tests {
+		if got := l.Revoked(tt.id); got != tt.want {
+			t.Errorf("Revoked(%q) = %v; want %v", tt.id, got, tt.want)
+		}
+	}
+
+	// Revoking an expired entry again prunes it.
+	l.Revoke("other", now.Add(time.Hour))
+	if _, ok := l.entries["expired"]; ok {
+		t.Error("expired entry was not pruned")
+	}
+}
+
+func TestRevokedAt(t *testing.T) {
+	l := NewRevocationList()
+	if _, ok := l.RevokedAt("user:1"); ok {
+		t.Fatal("RevokedAt should report false for an unknown ID")
+	}
+
+	before := time.Now()
+	l.Revoke("user:1", before.Add(time.Hour))
+	first, ok := l.RevokedAt("user:1")
+	if !ok || first.Before(before) {
+		t.Fatalf("RevokedAt = %v, %v; want a time after %v", first, ok, before)
+	}
+
+	// Revoking again moves the revocation time forward, but doesn't shorten the expiry.
+	time.Sleep(time.Millisecond)
+	l.Revoke("user:1", before.Add(time.Minute))
+	second, ok := l.RevokedAt("user:1")
+	if !ok || !second.After(first) {
+		t.Errorf("RevokedAt after revoking again = %v, %v; want a time after %v", second, ok, first)
+	}
+	if expiry := l.entries["user:1"].expiry; !expiry.Equal(before.Add(time.Hour)) {
+		t.Errorf("expiry = %v; want %v", expiry, before.Add(time.Hour))
+	}
+
+	l.Revoke("user:2", time.Now().Add(-time.Second))
+	if _, ok := l.RevokedAt("user:2"); ok {
+		t.Error("RevokedAt should report false once the entry has expired")
+	}
+}
@@ -59,7 +59,9 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 	msg.AddAlternative("text/html", htmlBody.String())
 
 	// Try sending the email up to three times before aborting and returning the final
-	// error. We sleep for 500 milliseconds between each attempt.
+	// error. We sleep for 500 milliseconds between each attempt. Longer-term retries
+	// with backoff are handled by the email queue, so it's important that the final
+	// error is returned to the caller rather than swallowed here.
 	for i := 1; i <= 3; i++ {
 		err = m.dialer.DialAndSend(msg)
 		// If everything worked, return nil.
@@ -70,5 +72,5 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 		time.Sleep(500 * time.Millisecond)
 	}
 
-	return nil
+	return err
 }
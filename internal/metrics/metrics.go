@@ -0,0 +1,305 @@
+// Package metrics implements the small subset of Prometheus instrumentation which the
+// API needs (counters, gauges and histograms, optionally with labels) and writes them
+// in the Prometheus text exposition format, so that they can be scraped without pulling
+// in the full client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the default histogram buckets, in seconds, which suit the latency
+// of typical HTTP requests.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	rxMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	rxLabelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// metric is implemented by each type of metric which can be added to a Registry.
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds a set of metrics. It implements http.Handler, serving the metrics in
+// the Prometheus text format, in the order they were registered.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register adds a metric to the registry. As metrics are registered at start up, by
+// the application itself, an invalid or duplicate name is a programming error, so it
+// panics.
+func (r *Registry) register(m metric, labels []string) {
+	if !rxMetricName.MatchString(m.name()) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", m.name()))
+	}
+	for _, label := range labels {
+		if !rxLabelName.MatchString(label) || strings.HasPrefix(label, "__") {
+			panic(fmt.Sprintf("metrics: invalid label name %q for %s", label, m.name()))
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[m.name()] {
+		panic(fmt.Sprintf("metrics: duplicate metric %s", m.name()))
+	}
+	r.names[m.name()] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// NewCounterVec registers a counter, which is split into a separate series for each
+// combination of values of the labels. With no labels, it is a single counter.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{vec: newVec(name, help, labels), values: make(map[string]float64)}
+	r.register(c, labels)
+	return c
+}
+
+// NewHistogramVec registers a histogram with the given upper bounds for its buckets,
+// which must be in increasing order. The +Inf bucket is added automatically.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	for i := range buckets {
+		if i > 0 && buckets[i] <= buckets[i-1] {
+			panic(fmt.Sprintf("metrics: buckets for %s must be in increasing order", name))
+		}
+	}
+	for _, label := range labels {
+		if label == "le" {
+			panic(fmt.Sprintf("metrics: histogram %s can't use the label le", name))
+		}
+	}
+	h := &HistogramVec{vec: newVec(name, help, labels), buckets: buckets, series: make(map[string]*histogram)}
+	r.register(h, labels)
+	return h
+}
+
+// NewGaugeFunc registers a gauge whose value is read by calling fn each time the metrics
+// are written, such as the number of open database connections.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{vec: newVec(name, help, nil), kind: "gauge", fn: fn}, nil)
+}
+
+// NewCounterFunc registers a counter whose value is read by calling fn each time the
+// metrics are written. fn must never return a smaller value than before.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{vec: newVec(name, help, nil), kind: "counter", fn: fn}, nil)
+}
+
+// Write writes all of the metrics in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// vec holds the parts common to every metric: its name, help text and label names.
+type vec struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func newVec(name, help string, labels []string) vec {
+	return vec{metricName: name, help: help, labels: labels}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+// key joins label values into a map key. It panics if the number of values doesn't
+// match the number of labels.
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.metricName, len(v.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (v *vec) writeHeader(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.metricName, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.metricName, kind)
+}
+
+// writeSample writes a single sample line. extra is an additional label pair (such as
+// the le label of a histogram bucket) to add after the metric's own labels.
+func (v *vec) writeSample(w *bufio.Writer, suffix, key string, extra []string, value float64) {
+	w.WriteString(v.metricName)
+	w.WriteString(suffix)
+	var pairs []string
+	if len(v.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, v.labels[i]+`="`+escapeLabel(value)+`"`)
+		}
+	}
+	if extra != nil {
+		pairs = append(pairs, extra[0]+`="`+escapeLabel(extra[1])+`"`)
+	}
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+// CounterVec is a counter, optionally split by labels.
+type CounterVec struct {
+	vec
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// Inc adds 1 to the counter with the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the counter with the given label values.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s can't decrease", c.metricName))
+	}
+	key := c.key(labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		c.writeSample(w, "", key, nil, c.values[key])
+	}
+}
+
+// HistogramVec is a histogram, optionally split by labels.
+type HistogramVec struct {
+	vec
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // counts[i] is the number of observations in bucket i alone
+	sum    float64
+	count  uint64
+}
+
+// Observe records a value, such as a request duration in seconds, in the histogram with
+// the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			h.writeSample(w, "_bucket", key, []string{"le", formatFloat(upper)}, float64(cumulative))
+		}
+		h.writeSample(w, "_bucket", key, []string{"le", "+Inf"}, float64(s.count))
+		h.writeSample(w, "_sum", key, nil, s.sum)
+		h.writeSample(w, "_count", key, nil, float64(s.count))
+	}
+}
+
+// funcMetric is an unlabelled gauge or counter whose value comes from a function.
+type funcMetric struct {
+	vec
+	kind string
+	fn   func() float64
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	f.writeHeader(w, f.kind)
+	f.writeSample(w, "", "", nil, f.fn())
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
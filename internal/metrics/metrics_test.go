@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	reg := NewRegistry()
+
+	requests := reg.NewCounterVec("http_requests_total", "Number of requests.", "method", "path")
+	requests.Inc("GET", "/v1/movies")
+	requests.Add(2, "GET", "/v1/movies")
+	requests.Inc("POST", `/a "quoted"\path`+"\nwith a newline")
+
+	duration := reg.NewHistogramVec("http_request_duration_seconds", "Request duration.", []float64{0.1, 0.5, 1}, "method")
+	for _, v := range []float64{0.05, 0.1, 0.7, 3} {
+		duration.Observe(v, "GET")
+	}
+	duration.Observe(0.25, "DELETE")
+
+	reg.NewGaugeFunc("queue_depth", "Help with a \\ backslash\nand a newline.", func() float64 {
+		return math.NaN()
+	})
+	reg.NewCounterFunc("wait_seconds_total", "Time spent waiting.", func() float64 {
+		return 1.5
+	})
+
+	want := `# HELP http_requests_total Number of requests.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",path="/v1/movies"} 3
+http_requests_total{method="POST",path="/a \"quoted\"\\path\nwith a newline"} 1
+# HELP http_request_duration_seconds Request duration.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{method="DELETE",le="0.1"} 0
+http_request_duration_seconds_bucket{method="DELETE",le="0.5"} 1
+http_request_duration_seconds_bucket{method="DELETE",le="1"} 1
+http_request_duration_seconds_bucket{method="DELETE",le="+Inf"} 1
+http_request_duration_seconds_sum{method="DELETE"} 0.25
+http_request_duration_seconds_count{method="DELETE"} 1
+http_request_duration_seconds_bucket{method="GET",le="0.1"} 2
+http_request_duration_seconds_bucket{method="GET",le="0.5"} 2
+http_request_duration_seconds_bucket{method="GET",le="1"} 3
+http_request_duration_seconds_bucket{method="GET",le="+Inf"} 4
+http_request_duration_seconds_sum{method="GET"} 3.85
+http_request_duration_seconds_count{method="GET"} 4
+# HELP queue_depth Help with a \\ backslash\nand a newline.
+# TYPE queue_depth gauge
+queue_depth NaN
+# HELP wait_seconds_total Time spent waiting.
+# TYPE wait_seconds_total counter
+wait_seconds_total 1.5
+`
+
+	var buf bytes.Buffer
+	if err := reg.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{0.005, "0.005"},
+		{2.5, "2.5"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+	for _, tt := range tests {
+		if got := formatFloat(tt.v); got != tt.want {
+			t.Errorf("formatFloat(%v) = %q; want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	tests := []struct {
+		name     string
+		register func(reg *Registry)
+	}{
+		{"invalid metric name", func(reg *Registry) { reg.NewCounterVec("1bad", "") }},
+		{"invalid label name", func(reg *Registry) { reg.NewCounterVec("ok", "", "bad-label") }},
+		{"reserved label name", func(reg *Registry) { reg.NewCounterVec("ok", "", "__name") }},
+		{"duplicate metric", func(reg *Registry) {
+			reg.NewCounterVec("ok", "")
+			reg.NewCounterVec("ok", "")
+		}},
+		{"unordered buckets", func(reg *Registry) { reg.NewHistogramVec("ok", "", []float64{1, 0.5}) }},
+		{"histogram le label", func(reg *Registry) { reg.NewHistogramVec("ok", "", DefaultBuckets, "le") }},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", tt.name)
+				}
+			}()
+			tt.register(NewRegistry())
+		}()
+	}
+}
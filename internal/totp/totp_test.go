@@ -0,0 +1,113 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed used by the test vectors in RFC 6238 Appendix B.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCodeRFC6238(t *testing.T) {
+	// The RFC gives 8-digit codes; these are the same values truncated to 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := Code(rfcSecret, Step(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("Code at %d = %s; want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name     string
+		code     string
+		skew     int
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", Code(rfcSecret, current), 0, current, true},
+		{"surrounding whitespace", " " + Code(rfcSecret, current) + "\n", 0, current, true},
+		{"previous step within skew", Code(rfcSecret, current-1), 1, current - 1, true},
+		{"next step within skew", Code(rfcSecret, current+1), 1, current + 1, true},
+		{"previous step without skew", Code(rfcSecret, current-1), 0, 0, false},
+		{"outside skew", Code(rfcSecret, current-2), 1, 0, false},
+		{"wrong code", "000000", 1, 0, false},
+		{"non-numeric", "abcdef", 1, 0, false},
+		{"partly numeric", Code(rfcSecret, current)[:5] + "x", 1, 0, false},
+		{"too short", Code(rfcSecret, current)[:5], 1, 0, false},
+		{"too long", Code(rfcSecret, current) + "0", 1, 0, false},
+		{"empty", "", 1, 0, false},
+	}
+	for _, tt := range tests {
+		step, ok := Validate(rfcSecret, tt.code, now, tt.skew)
+		if ok != tt.wantOK || step != tt.wantStep {
+			t.Errorf("%s: Validate(%q) = %d, %v; want %d, %v", tt.name, tt.code, step, ok, tt.wantStep, tt.wantOK)
+		}
+	}
+}
+
+// The step returned by Validate is what callers store to stop codes being replayed: a
+// code accepted at the end of its step must report that step, not the current one, so
+// that it is rejected if it is presented again during the next step.
+func TestValidateReturnsMatchedStep(t *testing.T) {
+	issued := time.Unix(1234567890, 0)
+	code := Code(rfcSecret, Step(issued))
+
+	step, ok := Validate(rfcSecret, code, issued.Add(Period), 1)
+	if !ok {
+		t.Fatal("code from the previous step should be accepted with a skew of 1")
+	}
+	if step != Step(issued) {
+		t.Errorf("matched step = %d; want %d", step, Step(issued))
+	}
+	if later, ok := Validate(rfcSecret, code, issued.Add(2*Period), 1); ok && later <= step {
+		t.Errorf("code accepted again at step %d after step %d was used", later, step)
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != SecretSize || string(a) == string(b) {
+		t.Errorf("secrets should be %d random bytes", SecretSize)
+	}
+	if encoded := EncodeSecret(a); strings.Contains(encoded, "=") || len(encoded) != 32 {
+		t.Errorf("EncodeSecret = %q; want 32 base32 characters without padding", encoded)
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Greenlight", "alice@example.com", rfcSecret)
+	for _, want := range []string{
+		"otpauth://totp/Greenlight:alice@example.com?",
+		"secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		"issuer=Greenlight",
+		"digits=6",
+		"period=30",
+	} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("URI %q doesn't contain %q", uri, want)
+		}
+	}
+}
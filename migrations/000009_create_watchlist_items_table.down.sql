@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'watchlist:manage';
+DROP TABLE IF EXISTS watchlist_items;
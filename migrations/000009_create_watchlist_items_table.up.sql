@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS watchlist_items (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    movie_id bigint NOT NULL REFERENCES movies ON DELETE CASCADE,
+    added_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    watched_at timestamp(0) with time zone,
+    PRIMARY KEY (user_id, movie_id)
+);
+
+-- Add the watchlist permission, and grant it to every user who can already read movies.
+INSERT INTO permissions (code) VALUES ('watchlist:manage');
+
+INSERT INTO users_permissions
+SELECT users_permissions.user_id, (SELECT id FROM permissions WHERE code = 'watchlist:manage')
+FROM users_permissions
+INNER JOIN permissions ON users_permissions.permission_id = permissions.id
+WHERE permissions.code = 'movies:read';
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    code text UNIQUE NOT NULL,
+    name text NOT NULL,
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- Add the permission for managing roles, and seed the default roles.
+INSERT INTO permissions (code) VALUES ('roles:manage');
+
+INSERT INTO roles (code, name) VALUES ('viewer', 'Viewer'), ('editor', 'Editor'), ('admin', 'Administrator');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE (roles.code = 'viewer' AND permissions.code IN ('movies:read', 'watchlist:manage'))
+OR (roles.code = 'editor' AND permissions.code IN ('movies:read', 'movies:write', 'watchlist:manage', 'people:write'))
+OR roles.code = 'admin';
+
+-- Give existing users the role which matches the movie permissions they were granted
+-- directly. The direct grants are left in place.
+INSERT INTO users_roles
+SELECT DISTINCT users_permissions.user_id, roles.id
+FROM users_permissions
+INNER JOIN permissions ON users_permissions.permission_id = permissions.id
+INNER JOIN roles ON (permissions.code = 'movies:read' AND roles.code = 'viewer')
+    OR (permissions.code = 'movies:write' AND roles.code = 'editor');
@@ -0,0 +1,5 @@
+INSERT INTO permissions (code) VALUES ('admin:users');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.code = 'admin' AND permissions.code = 'admin:users';